@@ -0,0 +1,354 @@
+package gopherdiscovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// The admin API serves the state of the server over HTTP, for the operators
+// and the tools that do not speak mangos:
+//
+//	GET /members  the nodes with their last-seen time
+//	GET /options  the options of the server, without the keys
+//	GET /health   the health of the server and of the nodes
+//	GET /events   Server-Sent Events with every change of the membership
+
+// AdminMembers is the reply of /members
+type AdminMembers struct {
+	Origin   string      `json:"origin"`
+	Revision uint64      `json:"revision"`
+	Nodes    []AdminNode `json:"nodes"`
+}
+
+// AdminNode is a node known by the server, also the ones left out of the
+// membership because of their health
+type AdminNode struct {
+	// Record with the worst of the reported and the probed health
+	Record   ServiceRecord `json:"record"`
+	LastSeen time.Time     `json:"last_seen"`
+	// Missed is the number of consecutive SURVEYS without response
+	Missed int `json:"missed"`
+	// Restored is true if the node was loaded from the Store and not seen
+	// since the restart
+	Restored bool `json:"restored,omitempty"`
+	// Probed is the health probed by the server
+	Probed HealthStatus `json:"probed,omitempty"`
+	// Excluded is true if the node is not in the membership because of its
+	// health
+	Excluded bool `json:"excluded,omitempty"`
+}
+
+// AdminHealth is the reply of /health, the status is critical once the
+// server is closed
+type AdminHealth struct {
+	Status   HealthStatus `json:"status"`
+	Leader   string       `json:"leader,omitempty"`
+	IsLeader bool         `json:"is_leader"`
+	Members  int          `json:"members"`
+	// Nodes counts the nodes by health, the ones without health check are
+	// not counted
+	Nodes    map[HealthStatus]int `json:"nodes"`
+	Rejected uint64               `json:"rejected"`
+	Denied   uint64               `json:"denied"`
+}
+
+// adminOptions are the Options served by /options, the keys are only
+// reported as enabled
+type adminOptions struct {
+	URLServer string `json:"url_server"`
+	URLPubSub string `json:"url_pubsub"`
+
+	SurveyTime       string `json:"survey_time"`
+	RecvDeadline     string `json:"recv_deadline"`
+	PollTime         string `json:"poll_time"`
+	MaxMissedSurveys int    `json:"max_missed_surveys"`
+	TTL              string `json:"ttl"`
+	WarmUp           string `json:"warm_up"`
+	RepublishTime    string `json:"republish_time"`
+
+	ControlURL      string   `json:"control_url,omitempty"`
+	ElectionURL     string   `json:"election_url,omitempty"`
+	ElectionPeers   []string `json:"election_peers,omitempty"`
+	ServerID        string   `json:"server_id,omitempty"`
+	HeartbeatTime   string   `json:"heartbeat_time"`
+	ElectionTimeout string   `json:"election_timeout"`
+
+	TLS              bool   `json:"tls"`
+	SharedKey        bool   `json:"shared_key"`
+	SigningKey       bool   `json:"signing_key"`
+	Admission        bool   `json:"admission"`
+	Store            bool   `json:"store"`
+	Codec            byte   `json:"codec"`
+	ExcludeUnhealthy bool   `json:"exclude_unhealthy"`
+	Prober           bool   `json:"prober"`
+	ProbeInterval    string `json:"probe_interval"`
+	ProbeConcurrency int    `json:"probe_concurrency"`
+}
+
+// AdminHandler returns the handler of the admin API, to serve it on any
+// http.Server. The server serves it on the AdminAddr of the Options.
+func (d *DiscoveryServer) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/members", d.serveMembers)
+	mux.HandleFunc("/options", d.serveOptions)
+	mux.HandleFunc("/health", d.serveHealth)
+	mux.HandleFunc("/events", d.serveEvents)
+	return mux
+}
+
+// AdminURL returns the url of the admin API, empty if there is no AdminAddr
+func (d *DiscoveryServer) AdminURL() string {
+	if d.adminListener == nil {
+		return ""
+	}
+	return "http://" + d.adminListener.Addr().String()
+}
+
+// listenAdmin listens on the AdminAddr, the admin API is served until the
+// server is closed
+func (d *DiscoveryServer) listenAdmin() error {
+	listener, err := net.Listen("tcp", d.opt.AdminAddr)
+	if err != nil {
+		return err
+	}
+	d.adminListener = listener
+	return nil
+}
+
+const (
+	// adminReadHeaderTimeout is the time to read the headers of a request
+	adminReadHeaderTimeout = 5 * time.Second
+	// adminIdleTimeout is the time a keep-alive connection waits for the
+	// next request. There is no write timeout, /events streams until the
+	// client or the server goes away.
+	adminIdleTimeout = 60 * time.Second
+)
+
+func (d *DiscoveryServer) serveAdmin() {
+	server := &http.Server{
+		Handler:           d.AdminHandler(),
+		ReadHeaderTimeout: adminReadHeaderTimeout,
+		IdleTimeout:       adminIdleTimeout,
+	}
+	d.goRun(func() {
+		<-d.ctx.Done()
+		server.Close()
+	})
+
+	err := server.Serve(d.adminListener)
+	if err != nil && err != http.ErrServerClosed {
+		d.logger.Error("DiscoveryServer: Error serving the admin API", "addr", d.opt.AdminAddr, "error", err)
+	}
+}
+
+func (d *DiscoveryServer) serveMembers(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	writeJSON(w, http.StatusOK, d.services.adminMembers())
+}
+
+func (d *DiscoveryServer) serveOptions(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	opt := d.opt
+	var codec byte
+	if opt.Codec != nil {
+		codec = opt.Codec.ID()
+	} else {
+		codec = JSONCodec.ID()
+	}
+
+	writeJSON(w, http.StatusOK, adminOptions{
+		URLServer: d.urlServer,
+		URLPubSub: d.urlPubSub,
+
+		SurveyTime:       opt.SurveyTime.String(),
+		RecvDeadline:     opt.RecvDeadline.String(),
+		PollTime:         opt.PollTime.String(),
+		MaxMissedSurveys: opt.MaxMissedSurveys,
+		TTL:              opt.TTL.String(),
+		WarmUp:           opt.WarmUp.String(),
+		RepublishTime:    opt.RepublishTime.String(),
+
+		ControlURL:      opt.ControlURL,
+		ElectionURL:     opt.ElectionURL,
+		ElectionPeers:   opt.ElectionPeers,
+		ServerID:        opt.ServerID,
+		HeartbeatTime:   opt.HeartbeatTime.String(),
+		ElectionTimeout: opt.ElectionTimeout.String(),
+
+		TLS:              opt.Transport.TLSConfig != nil,
+		SharedKey:        len(opt.SharedKey) > 0,
+		SigningKey:       opt.SigningKey != nil,
+		Admission:        opt.Admission != nil,
+		Store:            opt.Store != nil,
+		Codec:            codec,
+		ExcludeUnhealthy: opt.ExcludeUnhealthy,
+		Prober:           opt.Prober != nil,
+		ProbeInterval:    opt.ProbeInterval.String(),
+		ProbeConcurrency: opt.ProbeConcurrency,
+	})
+}
+
+func (d *DiscoveryServer) serveHealth(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	members := d.services.adminMembers()
+
+	health := AdminHealth{
+		Status:   HealthPassing,
+		Leader:   d.Leader(),
+		IsLeader: d.IsLeader(),
+		Nodes:    make(map[HealthStatus]int),
+		Rejected: atomic.LoadUint64(&d.rejected),
+		Denied:   atomic.LoadUint64(&d.denied),
+	}
+	for _, n := range members.Nodes {
+		if !n.Excluded {
+			health.Members++
+		}
+		if n.Record.Health != "" {
+			health.Nodes[n.Record.Health]++
+		}
+	}
+	if d.election != nil && health.Leader == "" {
+		// nobody publishes the membership yet
+		health.Status = HealthWarning
+	}
+
+	status := http.StatusOK
+	if d.ctx.Err() != nil {
+		health.Status = HealthCritical
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, health)
+}
+
+// serveEvents streams the current membership as a snapshot event, and then
+// every change as an update event. The id of the events is the revision, a
+// client that falls behind misses the changes and sees a gap in the ids.
+func (d *DiscoveryServer) serveEvents(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// watch before the snapshot, so no change is lost in between
+	updates, stop := d.services.watch()
+	defer stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	d.streamEvents(w, flusher, r, d.services.Snapshot(), updates)
+}
+
+// streamEvents writes the snapshot and then the updates newer than it, the
+// changes between the watch and the snapshot are already in the snapshot
+func (d *DiscoveryServer) streamEvents(w http.ResponseWriter, flusher http.Flusher, r *http.Request, snapshot Update, updates chan Update) {
+	err := writeEvent(w, "snapshot", snapshot)
+	for err == nil {
+		flusher.Flush()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-d.ctx.Done():
+			return
+		case update := <-updates:
+			if update.Revision <= snapshot.Revision {
+				continue
+			}
+			err = writeEvent(w, "update", update)
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event string, update Update) error {
+	data, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", update.Revision, event, data)
+	return err
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func allowGet(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+// adminMembers returns every node known, sorted by ID
+func (s *Services) adminMembers() AdminMembers {
+	s.Lock()
+	defer s.Unlock()
+
+	members := AdminMembers{Origin: s.origin, Revision: s.revision, Nodes: []AdminNode{}}
+	records := s.records()
+	for id, n := range s.nodes {
+		record := n.record
+		record.Health = worstHealth(record.Health, n.probed)
+		_, member := records[id]
+
+		members.Nodes = append(members.Nodes, AdminNode{
+			Record:   record,
+			LastSeen: n.lastSeen,
+			Missed:   n.missed,
+			Restored: n.restored,
+			Probed:   n.probed,
+			Excluded: !member,
+		})
+	}
+	sort.Slice(members.Nodes, func(i, j int) bool {
+		return members.Nodes[i].Record.ID < members.Nodes[j].Record.ID
+	})
+	return members
+}
+
+// watch returns a channel with every change of the membership, the changes
+// are dropped while the channel is full. stop releases the channel.
+func (s *Services) watch() (updates chan Update, stop func()) {
+	s.Lock()
+	defer s.Unlock()
+
+	updates = make(chan Update, 16)
+	s.watchers[updates] = struct{}{}
+	return updates, func() {
+		s.Lock()
+		defer s.Unlock()
+		delete(s.watchers, updates)
+	}
+}
+
+// notify sends the update to the watchers without blocking
+func (s *Services) notify(update Update) {
+	for watcher := range s.watchers {
+		select {
+		case watcher <- update:
+		default:
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package gopherdiscovery
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func getJSON(handler http.Handler, path string, value interface{}) int {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	json.Unmarshal(rec.Body.Bytes(), value)
+	return rec.Code
+}
+
+// readEvent reads the next Server-Sent Event of the stream
+func readEvent(r *bufio.Reader) (string, Update, error) {
+	var event string
+	var update Update
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", update, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			return event, update, nil
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			err = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &update)
+			if err != nil {
+				return "", update, err
+			}
+		}
+	}
+}
+
+func TestAdminAPI(t *testing.T) {
+	Convey("The admin API serves the members, the options and the health", t, func() {
+		opts := defaultOpts
+		opts.SharedKey = []byte("secret")
+		opts.ExcludeUnhealthy = true
+		server, err := Server("inproc://survey/44", "inproc://pubsub/44", opts)
+		So(err, ShouldBeNil)
+		handler := server.AdminHandler()
+
+		now := time.Now()
+		server.services.Add(map[string]ServiceRecord{
+			"client1": {ID: "client1", Address: "client1", Health: HealthPassing},
+			"client2": {ID: "client2", Address: "client2", Health: HealthCritical},
+		})
+
+		var members AdminMembers
+		So(getJSON(handler, "/members", &members), ShouldEqual, http.StatusOK)
+		So(members.Revision, ShouldEqual, 1)
+		So(members.Nodes, ShouldHaveLength, 2)
+		So(members.Nodes[0].Record.ID, ShouldEqual, "client1")
+		So(members.Nodes[0].Excluded, ShouldBeFalse)
+		So(members.Nodes[0].LastSeen, ShouldHappenOnOrAfter, now.Truncate(time.Second))
+		So(members.Nodes[1].Record.ID, ShouldEqual, "client2")
+		So(members.Nodes[1].Excluded, ShouldBeTrue)
+
+		var options map[string]interface{}
+		So(getJSON(handler, "/options", &options), ShouldEqual, http.StatusOK)
+		So(options["poll_time"], ShouldEqual, defaultOpts.PollTime.String())
+		So(options["shared_key"], ShouldEqual, true)
+		So(options["exclude_unhealthy"], ShouldEqual, true)
+
+		var health AdminHealth
+		So(getJSON(handler, "/health", &health), ShouldEqual, http.StatusOK)
+		So(health.Status, ShouldEqual, HealthPassing)
+		So(health.IsLeader, ShouldBeTrue)
+		So(health.Members, ShouldEqual, 1)
+		So(health.Nodes, ShouldResemble, map[HealthStatus]int{HealthPassing: 1, HealthCritical: 1})
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("POST", "/members", nil))
+		So(rec.Code, ShouldEqual, http.StatusMethodNotAllowed)
+
+		So(server.Close(), ShouldBeNil)
+		So(getJSON(handler, "/health", &health), ShouldEqual, http.StatusServiceUnavailable)
+		So(health.Status, ShouldEqual, HealthCritical)
+	})
+
+	Convey("The stream does not repeat the changes already in the snapshot", t, func() {
+		server, err := Server("inproc://survey/52", "inproc://pubsub/52", defaultOpts)
+		So(err, ShouldBeNil)
+		defer server.Cancel()
+
+		// client1 was added between the watch and the snapshot
+		a := ServiceRecord{ID: "client1", Address: "client1"}
+		b := ServiceRecord{ID: "client2", Address: "client2"}
+		snapshot := Update{Origin: "o", Revision: 1, Records: []ServiceRecord{a}}
+		updates := make(chan Update, 2)
+		updates <- Update{Origin: "o", Revision: 1, Records: []ServiceRecord{a},
+			Events: []Event{{Type: Added, Record: a, Revision: 1}}}
+		updates <- Update{Origin: "o", Revision: 2, Records: []ServiceRecord{a, b},
+			Events: []Event{{Type: Added, Record: b, Revision: 2}}}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		rec := httptest.NewRecorder()
+		done := make(chan struct{})
+		go func() {
+			server.streamEvents(rec, rec, httptest.NewRequest("GET", "/events", nil).WithContext(ctx), snapshot, updates)
+			close(done)
+		}()
+		ok := waitFor(time.Second, func() bool { return len(updates) == 0 })
+		So(ok, ShouldBeTrue)
+		cancel()
+		<-done
+
+		r := bufio.NewReader(rec.Body)
+		event, update, err := readEvent(r)
+		So(err, ShouldBeNil)
+		So(event, ShouldEqual, "snapshot")
+		So(update.Revision, ShouldEqual, 1)
+		event, update, err = readEvent(r)
+		So(err, ShouldBeNil)
+		So(event, ShouldEqual, "update")
+		So(update.Revision, ShouldEqual, 2)
+		_, _, err = readEvent(r)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("The server streams the changes of the membership on the AdminAddr", t, func() {
+		opts := defaultOpts
+		opts.AdminAddr = "127.0.0.1:0"
+		server, err := Server("inproc://survey/45", "inproc://pubsub/45", opts)
+		So(err, ShouldBeNil)
+		So(server.AdminURL(), ShouldStartWith, "http://127.0.0.1:")
+
+		resp, err := http.Get(server.AdminURL() + "/events")
+		So(err, ShouldBeNil)
+		So(resp.Header.Get("Content-Type"), ShouldEqual, "text/event-stream")
+		r := bufio.NewReader(resp.Body)
+
+		event, update, err := readEvent(r)
+		So(err, ShouldBeNil)
+		So(event, ShouldEqual, "snapshot")
+		So(update.Records, ShouldBeEmpty)
+
+		client, err := Client("inproc://survey/45", "client1")
+		So(err, ShouldBeNil)
+		event, update, err = readEvent(r)
+		So(err, ShouldBeNil)
+		So(event, ShouldEqual, "update")
+		So(ids(update.Records), ShouldResemble, []string{"client1"})
+		So(update.Events[0].Type, ShouldEqual, Added)
+
+		So(client.Close(), ShouldBeNil)
+		event, update, err = readEvent(r)
+		So(err, ShouldBeNil)
+		So(update.Records, ShouldBeEmpty)
+		So(update.Events[0].Type, ShouldEqual, Removed)
+
+		// the stream ends when the server is closed
+		So(server.Close(), ShouldBeNil)
+		_, _, err = readEvent(r)
+		So(err, ShouldNotBeNil)
+		resp.Body.Close()
+
+		_, err = http.Get(server.AdminURL() + "/health")
+		So(err, ShouldNotBeNil)
+	})
+}
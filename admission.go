@@ -0,0 +1,121 @@
+package gopherdiscovery
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var (
+	ErrIDNotAllowed      = errors.New("The ID of the node is not allowed")
+	ErrServiceNotAllowed = errors.New("The service of the node is not allowed")
+	ErrAddressNotAllowed = errors.New("The address of the node is not allowed")
+	ErrTooManyNodes      = errors.New("The membership has too many nodes")
+)
+
+// AdmissionPolicy decides which nodes join the membership. The server asks
+// the policy for every SURVEY response, members is the number of other nodes
+// in the membership if the node is admitted. The node is left out of the
+// membership if the policy returns an error.
+type AdmissionPolicy interface {
+	Admit(r ServiceRecord, members int) error
+}
+
+// AdmissionFunc is a function used as AdmissionPolicy
+type AdmissionFunc func(r ServiceRecord, members int) error
+
+func (f AdmissionFunc) Admit(r ServiceRecord, members int) error {
+	return f(r, members)
+}
+
+// RegexpPolicy admits the nodes whose ID and Service match the expressions,
+// a nil expression matches everything
+type RegexpPolicy struct {
+	ID      *regexp.Regexp
+	Service *regexp.Regexp
+}
+
+func (p RegexpPolicy) Admit(r ServiceRecord, members int) error {
+	if p.ID != nil && !p.ID.MatchString(r.ID) {
+		return ErrIDNotAllowed
+	}
+	if p.Service != nil && !p.Service.MatchString(r.Service) {
+		return ErrServiceNotAllowed
+	}
+	return nil
+}
+
+// CIDRPolicy admits the nodes whose Address is an IP in any of the networks.
+// The Address can be an IP, host:port or an url like http://10.0.0.1:8080
+type CIDRPolicy struct {
+	Networks []*net.IPNet
+}
+
+// NewCIDRPolicy parses the networks in CIDR notation, for example 10.0.0.0/8
+func NewCIDRPolicy(cidrs ...string) (CIDRPolicy, error) {
+	var policy CIDRPolicy
+
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return CIDRPolicy{}, err
+		}
+		policy.Networks = append(policy.Networks, network)
+	}
+	return policy, nil
+}
+
+func (p CIDRPolicy) Admit(r ServiceRecord, members int) error {
+	ip := net.ParseIP(addressHost(r.Address))
+	if ip == nil {
+		return ErrAddressNotAllowed
+	}
+	for _, network := range p.Networks {
+		if network.Contains(ip) {
+			return nil
+		}
+	}
+	return ErrAddressNotAllowed
+}
+
+// MaxNodes caps the number of nodes in the membership, the nodes already in
+// the membership stay in it
+type MaxNodes int
+
+func (max MaxNodes) Admit(r ServiceRecord, members int) error {
+	if members >= int(max) {
+		return ErrTooManyNodes
+	}
+	return nil
+}
+
+// AllOf admits the nodes admitted by every policy
+type AllOf []AdmissionPolicy
+
+func (policies AllOf) Admit(r ServiceRecord, members int) error {
+	for _, policy := range policies {
+		err := policy.Admit(r, members)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addressHost returns the host of the address, the address can be an url,
+// host:port or just the host
+func addressHost(address string) string {
+	if strings.Contains(address, "://") {
+		u, err := url.Parse(address)
+		if err == nil {
+			return u.Hostname()
+		}
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err == nil {
+		return host
+	}
+	return strings.Trim(address, "[]")
+}
@@ -0,0 +1,52 @@
+package gopherdiscovery
+
+import (
+	"regexp"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRegexpPolicy(t *testing.T) {
+	Convey("The RegexpPolicy admits the IDs and services that match", t, func() {
+		policy := RegexpPolicy{ID: regexp.MustCompile(`^prod-`), Service: regexp.MustCompile(`^(api|cache)$`)}
+
+		So(policy.Admit(ServiceRecord{ID: "prod-1", Service: "api"}, 0), ShouldBeNil)
+		So(policy.Admit(ServiceRecord{ID: "dev-1", Service: "api"}, 0), ShouldEqual, ErrIDNotAllowed)
+		So(policy.Admit(ServiceRecord{ID: "prod-2", Service: "worker"}, 0), ShouldEqual, ErrServiceNotAllowed)
+
+		So(RegexpPolicy{}.Admit(ServiceRecord{ID: "any"}, 0), ShouldBeNil)
+	})
+}
+
+func TestCIDRPolicy(t *testing.T) {
+	Convey("The CIDRPolicy admits the addresses in the networks", t, func() {
+		policy, err := NewCIDRPolicy("10.0.0.0/8", "fd00::/8")
+		So(err, ShouldBeNil)
+
+		So(policy.Admit(ServiceRecord{Address: "http://10.1.2.3:8080"}, 0), ShouldBeNil)
+		So(policy.Admit(ServiceRecord{Address: "tcp://10.1.2.3:40007"}, 0), ShouldBeNil)
+		So(policy.Admit(ServiceRecord{Address: "10.1.2.3:8080"}, 0), ShouldBeNil)
+		So(policy.Admit(ServiceRecord{Address: "10.1.2.3"}, 0), ShouldBeNil)
+		So(policy.Admit(ServiceRecord{Address: "[fd00::1]:8080"}, 0), ShouldBeNil)
+
+		So(policy.Admit(ServiceRecord{Address: "http://192.168.1.1:8080"}, 0), ShouldEqual, ErrAddressNotAllowed)
+		So(policy.Admit(ServiceRecord{Address: "http://example.com"}, 0), ShouldEqual, ErrAddressNotAllowed)
+		So(policy.Admit(ServiceRecord{Address: ""}, 0), ShouldEqual, ErrAddressNotAllowed)
+
+		_, err = NewCIDRPolicy("10.0.0.0")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestMaxNodesAndAllOf(t *testing.T) {
+	Convey("MaxNodes caps the membership and AllOf needs every policy", t, func() {
+		So(MaxNodes(2).Admit(ServiceRecord{ID: "a"}, 1), ShouldBeNil)
+		So(MaxNodes(2).Admit(ServiceRecord{ID: "a"}, 2), ShouldEqual, ErrTooManyNodes)
+
+		policy := AllOf{RegexpPolicy{ID: regexp.MustCompile(`^prod-`)}, MaxNodes(1)}
+		So(policy.Admit(ServiceRecord{ID: "prod-1"}, 0), ShouldBeNil)
+		So(policy.Admit(ServiceRecord{ID: "prod-1"}, 1), ShouldEqual, ErrTooManyNodes)
+		So(policy.Admit(ServiceRecord{ID: "dev-1"}, 0), ShouldEqual, ErrIDNotAllowed)
+	})
+}
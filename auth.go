@@ -0,0 +1,109 @@
+package gopherdiscovery
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+// Signed messages wrap a frame with its signature:
+// [signedVersion][length of the signature, 2 bytes][signature][frame]
+const signedVersion byte = 2
+
+// nonceLen is the size of the nonce the server sends in every SURVEY
+const nonceLen = 16
+
+var (
+	ErrNotSigned    = errors.New("The message is not signed")
+	ErrBadSignature = errors.New("The signature of the message is not valid")
+)
+
+func encodeSigned(signature []byte, frame []byte) []byte {
+	msg := make([]byte, 3, 3+len(signature)+len(frame))
+	msg[0] = signedVersion
+	binary.BigEndian.PutUint16(msg[1:3], uint16(len(signature)))
+	msg = append(msg, signature...)
+	return append(msg, frame...)
+}
+
+// decodeSigned returns the signature and the frame of a signed message
+func decodeSigned(msg []byte) ([]byte, []byte, error) {
+	if len(msg) < 3 || msg[0] != signedVersion {
+		return nil, nil, ErrNotSigned
+	}
+	n := int(binary.BigEndian.Uint16(msg[1:3]))
+	if len(msg) < 3+n {
+		return nil, nil, ErrNotSigned
+	}
+	return msg[3 : 3+n], msg[3+n:], nil
+}
+
+func newNonce() ([]byte, error) {
+	nonce := make([]byte, nonceLen)
+	_, err := rand.Read(nonce)
+	return nonce, err
+}
+
+// signResponse signs the SURVEY response with the nonce of the SURVEY, so the
+// response can not be replayed in another SURVEY
+func signResponse(key []byte, nonce []byte, frame []byte) []byte {
+	return encodeSigned(responseMAC(key, nonce, frame), frame)
+}
+
+// verifyResponse checks the signature of the SURVEY response and returns the
+// frame signed
+func verifyResponse(key []byte, nonce []byte, msg []byte) ([]byte, error) {
+	mac, frame, err := decodeSigned(msg)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(mac, responseMAC(key, nonce, frame)) {
+		return nil, ErrBadSignature
+	}
+	return frame, nil
+}
+
+func responseMAC(key []byte, nonce []byte, frame []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(nonce)
+	mac.Write(frame)
+	return mac.Sum(nil)
+}
+
+// signMessage signs the frame and the context where it is sent, for example
+// the topic of a publication, so the frame can not be moved to another
+// context. The frame is not signed without key.
+func signMessage(key ed25519.PrivateKey, context []byte, frame []byte) []byte {
+	if key == nil {
+		return frame
+	}
+	return encodeSigned(ed25519.Sign(key, signedContent(context, frame)), frame)
+}
+
+// verifyMessage checks the signature of the message and returns the frame
+// signed. Without key it only removes the signature, if there is one.
+func verifyMessage(key ed25519.PublicKey, context []byte, msg []byte) ([]byte, error) {
+	signature, frame, err := decodeSigned(msg)
+	if key == nil {
+		if err != nil {
+			return msg, nil
+		}
+		return frame, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(key, signedContent(context, frame), signature) {
+		return nil, ErrBadSignature
+	}
+	return frame, nil
+}
+
+func signedContent(context []byte, frame []byte) []byte {
+	content := make([]byte, 0, len(context)+len(frame))
+	content = append(content, context...)
+	return append(content, frame...)
+}
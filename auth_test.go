@@ -0,0 +1,68 @@
+package gopherdiscovery
+
+import (
+	"crypto/ed25519"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestResponseSignature(t *testing.T) {
+	Convey("A signed response is verified with the same key and nonce", t, func() {
+		key := []byte("secret")
+		frame, err := encodeRecord(ServiceRecord{ID: "a", Address: "a"}, nil)
+		So(err, ShouldBeNil)
+
+		msg := signResponse(key, []byte("nonce"), frame)
+
+		verified, err := verifyResponse(key, []byte("nonce"), msg)
+		So(err, ShouldBeNil)
+		So(verified, ShouldResemble, frame)
+
+		_, err = verifyResponse([]byte("other"), []byte("nonce"), msg)
+		So(err, ShouldEqual, ErrBadSignature)
+
+		// replayed in another SURVEY
+		_, err = verifyResponse(key, []byte("another nonce"), msg)
+		So(err, ShouldEqual, ErrBadSignature)
+
+		_, err = verifyResponse(key, []byte("nonce"), frame)
+		So(err, ShouldEqual, ErrNotSigned)
+	})
+}
+
+func TestPublicationSignature(t *testing.T) {
+	Convey("A signed publication is verified with the public key", t, func() {
+		public, private, err := ed25519.GenerateKey(nil)
+		So(err, ShouldBeNil)
+		other, _, err := ed25519.GenerateKey(nil)
+		So(err, ShouldBeNil)
+		update := Update{Revision: 3, Records: []ServiceRecord{{ID: "a", Address: "a"}}}
+
+		msg, err := encodePublication(allTopic, update, nil, private)
+		So(err, ShouldBeNil)
+
+		topic, decoded, err := decodePublication(msg, public)
+		So(err, ShouldBeNil)
+		So(topic, ShouldEqual, allTopic)
+		So(decoded, ShouldResemble, update)
+
+		// without key the signature is ignored
+		_, decoded, err = decodePublication(msg, nil)
+		So(err, ShouldBeNil)
+		So(decoded, ShouldResemble, update)
+
+		_, _, err = decodePublication(msg, other)
+		So(err, ShouldEqual, ErrBadSignature)
+
+		// the signed update published on another topic
+		moved := append(subscription(serviceTopic("a")), msg[len(allTopic)+1:]...)
+		_, _, err = decodePublication(moved, public)
+		So(err, ShouldEqual, ErrBadSignature)
+
+		unsigned, err := encodePublication(allTopic, update, nil, nil)
+		So(err, ShouldBeNil)
+		_, _, err = decodePublication(unsigned, public)
+		So(err, ShouldEqual, ErrNotSigned)
+	})
+}
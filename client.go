@@ -1,184 +1,480 @@
 package gopherdiscovery
 
 import (
+	"bytes"
+	"context"
 	"errors"
-	"log"
-	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gdamore/mangos"
 	"github.com/gdamore/mangos/protocol/respondent"
-	"github.com/gdamore/mangos/protocol/sub"
-
-	"github.com/gdamore/mangos/transport/ipc"
-	"github.com/gdamore/mangos/transport/tcp"
-	"golang.org/x/net/context"
 )
 
 type DiscoveryClient struct {
-	// url for the survey heartbeat
+	// urls for the survey heartbeat, one for every server
 	// for example tcp://127.0.0.1:40007
-	urlServer string
-	// url for the Pub/Sub
+	urlServers []string
+	// urls for the Pub/Sub, one for every server
 	// in this url you are going to get the changes on the set of nodes
 	// for example tcp://127.0.0.1:50007
-	urlPubSub string
-
-	// Service that needs to be discovered, for example for a web server could be
-	// http://192.168.1.1:8080
-	service string
-
-	ctx    context.Context
-	cancel context.CancelFunc
-	sock   mangos.Socket
+	urlPubSubs []string
+
+	// Record of the service that needs to be discovered, for example for a web
+	// server the Address could be http://192.168.1.1:8080
+	record ServiceRecord
+	// SURVEY response, the encoded record
+	response      []byte
+	responseMutex sync.Mutex
+	// key to sign the SURVEY responses
+	sharedKey []byte
+	codec     Codec
+
+	logger  Logger
+	metrics Metrics
+
+	// health of the record, nil if there is no health check
+	healthCheck    HealthCheck
+	healthInterval time.Duration
+
+	// SURVEY response when the client leaves the cluster
+	leave        []byte
+	leaveTimeout time.Duration
+	// closed by Close to leave the cluster
+	leaving   chan struct{}
+	leaveOnce sync.Once
+	// connection with every server
+	servers []*serverConn
+	// signalled when a server connects, disconnects or is closing
+	changed chan struct{}
+
+	lifecycle
+	// one respondent socket for every server, a respondent has only one peer
+	socks []mangos.Socket
 
 	subscriber *Subscriber
 }
 
-type Subscriber struct {
-	// url for the Pub/Sub
-	url string
-
-	ctx  context.Context
-	sock mangos.Socket
-
-	changes chan []string
+// serverConn is the connection of the client with a server, the client only
+// waits to leave the servers that are still connected
+type serverConn struct {
+	// pipes connected to the server
+	peers int32
+	// 1 once the server has said it is closing
+	closing int32
+	// time of the last SURVEY in UnixNano, and between the last two
+	surveyed int64
+	interval int64
+	// closed when run returns
+	done chan struct{}
 }
 
 func Client(urlServer string, service string) (*DiscoveryClient, error) {
 	return ClientWithSub(urlServer, "", service)
 }
 
+// ClientWithSub advertises the service using it as ID and Address of the record
 func ClientWithSub(urlServer string, urlPubSub string, service string) (*DiscoveryClient, error) {
-	var sock mangos.Socket
-	var err error
-	var subscriber *Subscriber
+	return ClientWithRecord(urlServer, urlPubSub, ServiceRecord{ID: service, Address: service})
+}
+
+type ClientOptions struct {
+	// Subscriber options used to discover the Peers, it uses the Transport of
+	// the client if it has no TLSConfig nor Transports
+	Subscriber SubscriberOptions
+
+	Transport TransportOptions
+
+	// SharedKey signs the SURVEY responses, it has to be the same key of the
+	// servers. Disabled if empty
+	SharedKey []byte
+
+	// Codec of the SURVEY responses, JSONCodec if nil
+	Codec Codec
+
+	// HealthCheck reports the health of the service in the SURVEY responses,
+	// it runs every HealthInterval or DefaultHealthInterval if 0. The first
+	// check runs before the client is created
+	HealthCheck    HealthCheck
+	HealthInterval time.Duration
+
+	// LeaveTimeout is the time Cancel waits for the SURVEYS to leave the
+	// cluster, DefaultLeaveTimeout if 0
+	LeaveTimeout time.Duration
+
+	// Logger of the client and its Subscriber if it has none, StdLogger if
+	// nil
+	Logger Logger
+
+	// Metrics of the client and its Subscriber if it has none. Disabled if nil
+	Metrics Metrics
+}
 
-	ctx, cancel := context.WithCancel(context.Background())
+// DefaultLeaveTimeout is the time a client waits for the SURVEYS to leave the
+// cluster, the servers remove it anyway once it misses the SURVEYS
+const DefaultLeaveTimeout = 2 * time.Second
 
+func ClientWithRecord(urlServer string, urlPubSub string, record ServiceRecord) (*DiscoveryClient, error) {
+	return ClientWithOptions(urlServer, urlPubSub, record, ClientOptions{})
+}
+
+func ClientWithOptions(urlServer string, urlPubSub string, record ServiceRecord, opt ClientOptions) (*DiscoveryClient, error) {
+	var urlPubSubs []string
 	if urlPubSub != "" {
-		subCtx, _ := context.WithCancel(ctx)
-		subscriber, err = NewSubscriber(subCtx, urlPubSub)
-		if err != nil {
-			return nil, err
-		}
+		urlPubSubs = []string{urlPubSub}
 	}
+	return ClusterClient([]string{urlServer}, urlPubSubs, record, opt)
+}
+
+// ClusterClient answers the SURVEYS of every server and gets the Peers from
+// any of their Pub/Sub
+func ClusterClient(urlServers []string, urlPubSubs []string, record ServiceRecord, opt ClientOptions) (*DiscoveryClient, error) {
+	return newClient(context.Background(), urlServers, urlPubSubs, record, opt)
+}
 
-	sock, err = respondent.NewSocket()
+func newClient(ctx context.Context, urlServers []string, urlPubSubs []string, record ServiceRecord, opt ClientOptions) (*DiscoveryClient, error) {
+	var socks []mangos.Socket
+	var err error
+	var subscriber *Subscriber
+	var response []byte
+	var leave []byte
+
+	if record.ID == "" {
+		return nil, errors.New("The ServiceRecord needs an ID")
+	}
+	if len(urlServers) == 0 {
+		return nil, errors.New("No server url is provided")
+	}
+	if opt.HealthCheck != nil {
+		record.Health = opt.HealthCheck()
+	}
+	response, err = encodeRecord(record, opt.Codec)
 	if err != nil {
 		return nil, err
 	}
-
-	sock.AddTransport(ipc.NewTransport())
-	sock.AddTransport(tcp.NewTransport())
-	err = sock.Dial(urlServer)
+	leave, err = encodeLeave(record, opt.Codec)
 	if err != nil {
 		return nil, err
 	}
+	if opt.LeaveTimeout == 0 {
+		opt.LeaveTimeout = DefaultLeaveTimeout
+	}
+	// the Subscriber shares the limits of the Logger
+	opt.Logger = newLogger(opt.Logger)
+
+	servers := make([]*serverConn, len(urlServers))
+	changed := make(chan struct{}, 1)
+	for i, url := range urlServers {
+		var sock mangos.Socket
+		servers[i] = &serverConn{done: make(chan struct{})}
+		sock, err = dialRespondent(url, opt.Transport, servers[i].portHook(changed))
+		if err != nil {
+			closeSockets(socks...)
+			return nil, err
+		}
+		socks = append(socks, sock)
+	}
+
+	if len(urlPubSubs) > 0 {
+		subscriber, err = NewClusterSubscriber(ctx, urlPubSubs, subscriberOptions(opt))
+		if err != nil {
+			closeSockets(socks...)
+			return nil, err
+		}
+	}
 
 	client := &DiscoveryClient{
-		urlServer:  urlServer,
-		urlPubSub:  urlPubSub,
-		service:    service,
-		ctx:        ctx,
-		cancel:     cancel,
-		sock:       sock,
+		urlServers: urlServers,
+		urlPubSubs: urlPubSubs,
+		record:     record,
+		response:   response,
+		sharedKey:  opt.SharedKey,
+		codec:      opt.Codec,
+		logger:     opt.Logger,
+		metrics:    orNoMetrics(opt.Metrics),
+		socks:      socks,
 		subscriber: subscriber,
+
+		healthCheck:    opt.HealthCheck,
+		healthInterval: opt.HealthInterval,
+
+		leave:        leave,
+		leaveTimeout: opt.LeaveTimeout,
+		leaving:      make(chan struct{}),
+		servers:      servers,
+		changed:      changed,
 	}
 
-	go client.run()
+	// the client keeps running while it leaves the cluster, after the ctx
+	// of the caller is done
+	client.init(context.Background())
+
+	client.closeOnDone(socks...)
+	for i := range socks {
+		server, url, sock := servers[i], urlServers[i], socks[i]
+		client.goRun(func() { client.run(server, url, sock) })
+	}
+	if client.healthCheck != nil {
+		client.goRun(client.checkHealth)
+	}
+	if ctx.Done() != nil {
+		client.goRun(func() { client.leaveOnDone(ctx) })
+	}
 	return client, nil
 }
 
-func (d *DiscoveryClient) Peers() (chan []string, error) {
+func dialRespondent(url string, opt TransportOptions, hook mangos.PortHook) (mangos.Socket, error) {
+	sock, err := respondent.NewSocket()
+	if err != nil {
+		return nil, err
+	}
+	sock.SetPortHook(hook)
+	err = addTransports(sock, opt)
+	if err != nil {
+		sock.Close()
+		return nil, err
+	}
+	err = dial(sock, url, opt)
+	if err != nil {
+		sock.Close()
+		return nil, err
+	}
+	return sock, nil
+}
+
+// subscriberOptions returns the options of the Subscriber, it uses the
+// Transport of the client if it has no TLSConfig nor Transports, and the
+// Logger and Metrics of the client if it has none
+func subscriberOptions(opt ClientOptions) SubscriberOptions {
+	sub := opt.Subscriber
+	if sub.Transport.TLSConfig == nil && len(sub.Transport.Transports) == 0 {
+		sub.Transport = opt.Transport
+	}
+	if sub.Logger == nil {
+		sub.Logger = opt.Logger
+	}
+	if sub.Metrics == nil {
+		sub.Metrics = opt.Metrics
+	}
+	return sub
+}
+
+func (d *DiscoveryClient) Peers() (chan []ServiceRecord, error) {
 	if d.subscriber == nil {
 		return nil, errors.New("No subscribe url is provided to discover the Peers")
 	}
 	return d.subscriber.Changes(), nil
 }
 
-func (d *DiscoveryClient) Cancel() {
-	d.cancel()
+// Close leaves the cluster, the client answers the SURVEYS with a leave so the
+// servers remove the node right away. The client waits until the leave is
+// sent to every server still connected, at most the LeaveTimeout after their
+// next SURVEY is due. The servers that are gone or closing are not waited.
+// Close closes the sockets and waits for the goroutines of the client and its
+// Subscriber.
+func (d *DiscoveryClient) Close() error {
+	d.leaveCluster()
+
+	err := d.close()
+	if d.subscriber != nil {
+		subErr := d.subscriber.Close()
+		if err == nil {
+			err = subErr
+		}
+	}
+	return err
 }
 
-func (d *DiscoveryClient) run() {
-	var err error
-	for {
-		_, err = d.sock.Recv()
-		if err != nil {
-			log.Println("DiscoveryClient: Cannot receive the SURVEY", err.Error())
-		} else {
-			select {
-			case <-d.ctx.Done():
-				return
+// leaveCluster answers the next SURVEYS with a leave, it waits for the leave
+// of every connected server
+func (d *DiscoveryClient) leaveCluster() {
+	d.leaveOnce.Do(func() {
+		close(d.leaving)
+		now := time.Now()
+		for _, server := range d.servers {
+			d.waitLeave(server, server.leaveDeadline(now, d.leaveTimeout))
+		}
+	})
+}
 
-			default:
-				err = d.sock.Send([]byte(d.service))
-				if err != nil {
-					log.Println("DiscoveryClient: Cannot send the SURVEY response", err.Error())
-				}
-			}
+// waitLeave waits until the leave is sent to the server, it stops waiting
+// when the server disconnects or is closing
+func (d *DiscoveryClient) waitLeave(server *serverConn, deadline time.Time) {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	for server.connected() {
+		select {
+		case <-server.done:
+			return
+		case <-d.changed:
+		case <-timer.C:
+			return
 		}
 	}
 }
 
-func NewSubscriber(ctx context.Context, url string) (*Subscriber, error) {
-	var sock mangos.Socket
-	var err error
-
-	sock, err = sub.NewSocket()
-	if err != nil {
-		return nil, err
+// portHook counts the pipes connected to the server
+func (s *serverConn) portHook(changed chan struct{}) mangos.PortHook {
+	return func(action mangos.PortAction, _ mangos.Port) bool {
+		switch action {
+		case mangos.PortActionAdd:
+			atomic.AddInt32(&s.peers, 1)
+		case mangos.PortActionRemove:
+			atomic.AddInt32(&s.peers, -1)
+		}
+		signal(changed)
+		return true
 	}
-	sock.AddTransport(ipc.NewTransport())
-	sock.AddTransport(tcp.NewTransport())
+}
 
-	err = sock.Dial(url)
-	if err != nil {
-		return nil, err
+// connected reports whether the server is connected and not closing, the
+// inproc:// pipes are not removed when the server is gone, only the closing
+// SURVEY tells
+func (s *serverConn) connected() bool {
+	return atomic.LoadInt32(&s.peers) > 0 && atomic.LoadInt32(&s.closing) == 0
+}
+
+// leaveDeadline is the LeaveTimeout after the next SURVEY of the server is due
+func (s *serverConn) leaveDeadline(now time.Time, timeout time.Duration) time.Time {
+	due := time.Unix(0, atomic.LoadInt64(&s.surveyed)).Add(time.Duration(atomic.LoadInt64(&s.interval)))
+	if due.Before(now) {
+		due = now
 	}
-	// subscribes to everything
-	err = sock.SetOption(mangos.OptionSubscribe, []byte(""))
-	if err != nil {
-		return nil, err
+	return due.Add(timeout)
+}
+
+// surveyedAt records the time of a SURVEY of the server
+func (s *serverConn) surveyedAt(now time.Time) {
+	last := atomic.SwapInt64(&s.surveyed, now.UnixNano())
+	if last > 0 {
+		atomic.StoreInt64(&s.interval, now.UnixNano()-last)
 	}
+}
 
-	subscriber := &Subscriber{
-		url:     url,
-		ctx:     ctx,
-		sock:    sock,
-		changes: make(chan []string, 8),
+// signal wakes up the receiver of the channel without blocking
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
 	}
+}
 
-	go subscriber.run()
-	return subscriber, nil
+// leaveOnDone leaves the cluster and stops the client once the context of
+// NewClient is done
+func (d *DiscoveryClient) leaveOnDone(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		d.leaveCluster()
+		d.cancel()
+	case <-d.ctx.Done():
+	}
 }
 
-func (s *Subscriber) Changes() chan []string {
-	return s.changes
+// Cancel leaves the cluster and stops the client, see Close
+func (d *DiscoveryClient) Cancel() {
+	d.Close()
 }
 
-func (s *Subscriber) run() {
-	var msg []byte
+// run answers the SURVEYS of the server, once the client leaves it returns
+// when the leave is sent
+func (d *DiscoveryClient) run(server *serverConn, url string, sock mangos.Socket) {
+	defer close(server.done)
+
 	var err error
+	var survey []byte
+	var response []byte
+	var backoff time.Duration
+	var left bool
 
 	for {
+		survey, err = sock.Recv()
+		if err != nil {
+			select {
+			case <-d.ctx.Done():
+				return
+			default:
+				d.logger.Error("DiscoveryClient: Cannot receive the SURVEY", "url", url, "id", d.record.ID, "error", err)
+				backoff = nextBackoff(backoff)
+				sleep(d.ctx, backoff)
+				continue
+			}
+		}
+		backoff = 0
+		if bytes.Equal(survey, closingSurvey) {
+			// acknowledge it, the server waits for its clients
+			atomic.StoreInt32(&server.closing, 1)
+			signal(d.changed)
+			sock.Send(nil)
+			continue
+		}
+		atomic.StoreInt32(&server.closing, 0)
+		server.surveyedAt(time.Now())
+
 		select {
-		case <-s.ctx.Done():
-			close(s.changes)
+		case <-d.ctx.Done():
 			return
+		case <-d.leaving:
+			left = true
+			response = d.leave
 		default:
-			msg, err = s.sock.Recv()
-			if err != nil {
-				log.Println("DiscoveryClient: Cannot SUBSCRIBE to the changes", err.Error())
+			response = d.currentResponse()
+		}
+		if len(d.sharedKey) > 0 {
+			response = signResponse(d.sharedKey, survey, response)
+		}
+		err = sock.Send(response)
+		if err != nil {
+			d.logger.Error("DiscoveryClient: Cannot send the SURVEY response", "url", url, "id", d.record.ID, "error", err)
+		} else {
+			d.metrics.Add(MetricSurveysAnswered, 1)
+		}
+		if left {
+			// closing the socket sends the queued leave before the pipe
+			return
+		}
+	}
+}
 
-			}
+func (d *DiscoveryClient) currentResponse() []byte {
+	d.responseMutex.Lock()
+	defer d.responseMutex.Unlock()
+	return d.response
+}
 
-			// non-blocking send to the channel, discards changes if the channel is not ready
-			select {
-			case s.changes <- strings.Split(string(msg), "|"):
-			default:
-			}
+// checkHealth runs the health check periodically, the SURVEY response changes
+// with the health
+func (d *DiscoveryClient) checkHealth() {
+	interval := d.healthInterval
+	if interval == 0 {
+		interval = DefaultHealthInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-ticker.C:
+			d.setHealth(d.healthCheck())
 		}
 	}
 }
+
+func (d *DiscoveryClient) setHealth(health HealthStatus) {
+	if health == d.record.Health {
+		return
+	}
+	d.record.Health = health
+
+	response, err := encodeRecord(d.record, d.codec)
+	if err != nil {
+		d.logger.Error("DiscoveryClient: Cannot encode the record", "id", d.record.ID, "service", d.record.Service, "error", err)
+		return
+	}
+	d.responseMutex.Lock()
+	d.response = response
+	d.responseMutex.Unlock()
+}
@@ -0,0 +1,104 @@
+package gopherdiscovery
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+)
+
+// Codec encodes the records of the SURVEY responses and the updates of the
+// membership. The ID of the codec is the format byte of the header, so every
+// message is decoded with the codec of the sender.
+type Codec interface {
+	// ID of the codec in the header, 1 to 3 are the built-in codecs
+	ID() byte
+	EncodeRecord(r ServiceRecord) ([]byte, error)
+	DecodeRecord(payload []byte) (ServiceRecord, error)
+	EncodeUpdate(u Update) ([]byte, error)
+	DecodeUpdate(payload []byte) (Update, error)
+}
+
+// Built-in codecs. The protobuf schema is in gopherdiscovery.proto, msgpack
+// uses the same maps and names as JSON.
+var (
+	JSONCodec     Codec = jsonCodec{}
+	ProtobufCodec Codec = protobufCodec{}
+	MsgpackCodec  Codec = msgpackCodec{}
+)
+
+var ErrCodecRegistered = errors.New("There is already a codec with the same ID")
+
+var (
+	codecsMutex sync.RWMutex
+	codecs      = map[byte]Codec{
+		formatJSON:     JSONCodec,
+		formatProtobuf: ProtobufCodec,
+		formatMsgpack:  MsgpackCodec,
+	}
+)
+
+// RegisterCodec makes the codec available to decode the messages, the
+// built-in codecs are always available
+func RegisterCodec(codec Codec) error {
+	codecsMutex.Lock()
+	defer codecsMutex.Unlock()
+
+	if _, ok := codecs[codec.ID()]; ok {
+		return ErrCodecRegistered
+	}
+	codecs[codec.ID()] = codec
+	return nil
+}
+
+// unregisterCodec removes a codec registered with RegisterCodec, the tests
+// leave the registry as they found it
+func unregisterCodec(id byte) {
+	codecsMutex.Lock()
+	defer codecsMutex.Unlock()
+	delete(codecs, id)
+}
+
+func codecByID(id byte) (Codec, error) {
+	codecsMutex.RLock()
+	defer codecsMutex.RUnlock()
+
+	codec, ok := codecs[id]
+	if !ok {
+		return nil, ErrUnknownFormat
+	}
+	return codec, nil
+}
+
+// orJSON returns the codec, JSONCodec if nil
+func orJSON(codec Codec) Codec {
+	if codec == nil {
+		return JSONCodec
+	}
+	return codec
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ID() byte {
+	return formatJSON
+}
+
+func (jsonCodec) EncodeRecord(r ServiceRecord) ([]byte, error) {
+	return json.Marshal(r)
+}
+
+func (jsonCodec) DecodeRecord(payload []byte) (ServiceRecord, error) {
+	var r ServiceRecord
+	err := json.Unmarshal(payload, &r)
+	return r, err
+}
+
+func (jsonCodec) EncodeUpdate(u Update) ([]byte, error) {
+	return json.Marshal(u)
+}
+
+func (jsonCodec) DecodeUpdate(payload []byte) (Update, error) {
+	var u Update
+	err := json.Unmarshal(payload, &u)
+	return u, err
+}
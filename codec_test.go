@@ -0,0 +1,123 @@
+package gopherdiscovery
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type customCodec struct {
+	jsonCodec
+}
+
+func (customCodec) ID() byte {
+	return 200
+}
+
+func TestCodecs(t *testing.T) {
+	record := ServiceRecord{
+		ID:       "api|1",
+		Address:  "http://10.0.0.2:8080",
+		Service:  "api",
+		Version:  "2",
+		Tags:     []string{"a", "b"},
+		Metadata: map[string]string{"zone": "b", "rack": "4"},
+		Health:   HealthWarning,
+	}
+	other := ServiceRecord{ID: "cache-1", Address: "cache-1"}
+	update := Update{
+		Origin:   "origin",
+		Revision: 300,
+		Records:  []ServiceRecord{record, other},
+		Events:   []Event{{Type: Added, Record: record, Revision: 300}, {Type: Removed, Record: other, Revision: 300}},
+	}
+
+	for _, codec := range []Codec{JSONCodec, ProtobufCodec, MsgpackCodec} {
+		Convey(fmt.Sprintf("Records and updates survive the codec %d", codec.ID()), t, func() {
+			msg, err := encodeRecord(record, codec)
+			So(err, ShouldBeNil)
+			So(msg[1], ShouldEqual, codec.ID())
+			decodedRecord, err := decodeRecord(msg)
+			So(err, ShouldBeNil)
+			So(decodedRecord, ShouldResemble, record)
+
+			msg, err = encodeUpdate(update, codec)
+			So(err, ShouldBeNil)
+			decoded, err := decodeUpdate(msg)
+			So(err, ShouldBeNil)
+			So(decoded, ShouldResemble, update)
+
+			msg, err = encodeUpdate(Update{Origin: "origin"}, codec)
+			So(err, ShouldBeNil)
+			decoded, err = decodeUpdate(msg)
+			So(err, ShouldBeNil)
+			So(decoded, ShouldResemble, Update{Origin: "origin"})
+		})
+	}
+
+	Convey("The protobuf codec follows gopherdiscovery.proto", t, func() {
+		msg, err := ProtobufCodec.EncodeRecord(ServiceRecord{ID: "a", Address: "b", Tags: []string{"c"}})
+		So(err, ShouldBeNil)
+		So(msg, ShouldResemble, []byte{0x0a, 1, 'a', 0x12, 1, 'b', 0x2a, 1, 'c'})
+
+		// unknown fields are skipped
+		msg = append(msg, 0x38, 0x96, 0x01)
+		decoded, err := ProtobufCodec.DecodeRecord(msg)
+		So(err, ShouldBeNil)
+		So(decoded, ShouldResemble, ServiceRecord{ID: "a", Address: "b", Tags: []string{"c"}})
+
+		_, err = ProtobufCodec.DecodeRecord([]byte{0x0a, 5, 'a'})
+		So(err, ShouldEqual, ErrInvalidProtobuf)
+	})
+
+	Convey("The msgpack codec uses the JSON names", t, func() {
+		msg, err := MsgpackCodec.EncodeRecord(ServiceRecord{ID: "a", Address: "b"})
+		So(err, ShouldBeNil)
+		So(msg, ShouldResemble, []byte{0x82, 0xa2, 'i', 'd', 0xa1, 'a', 0xa7, 'a', 'd', 'd', 'r', 'e', 's', 's', 0xa1, 'b'})
+
+		// revision as a signed integer of another encoder
+		decoded, err := MsgpackCodec.DecodeUpdate([]byte{0x81, 0xa8, 'r', 'e', 'v', 'i', 's', 'i', 'o', 'n', 0xd1, 0x01, 0x2c})
+		So(err, ShouldBeNil)
+		So(decoded.Revision, ShouldEqual, 300)
+
+		_, err = MsgpackCodec.DecodeRecord([]byte{0x82, 0xa2, 'i'})
+		So(err, ShouldEqual, ErrInvalidMsgpack)
+	})
+
+	Convey("The decoders reject nesting too deep and unknown events", t, func() {
+		deep := bytes.Repeat([]byte{0x91}, 100000)
+		_, err := mpDecode(append(deep, 0xc0))
+		So(err, ShouldEqual, ErrInvalidMsgpack)
+		_, err = mpDecode(append(deep[:mpMaxDepth], 0xc0))
+		So(err, ShouldBeNil)
+
+		event := pbAppendUint(nil, pbEventType, 42)
+		_, err = ProtobufCodec.DecodeUpdate(pbAppendBytes(nil, pbUpdateEvents, event))
+		So(err, ShouldNotBeNil)
+		// an event without type
+		event = pbAppendUint(nil, pbEventRevision, 3)
+		_, err = ProtobufCodec.DecodeUpdate(pbAppendBytes(nil, pbUpdateEvents, event))
+		So(err, ShouldNotBeNil)
+
+		update, err := MsgpackCodec.EncodeUpdate(Update{Events: []Event{{Type: Added}}})
+		So(err, ShouldBeNil)
+		update = bytes.Replace(update, []byte("added"), []byte("other"), 1)
+		_, err = MsgpackCodec.DecodeUpdate(update)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Only the registered codecs are decoded", t, func() {
+		msg := withHeader(200, []byte(`{"id":"a","address":"a"}`))
+		_, err := decodeRecord(msg)
+		So(err, ShouldEqual, ErrUnknownFormat)
+
+		So(RegisterCodec(customCodec{}), ShouldBeNil)
+		Reset(func() { unregisterCodec(customCodec{}.ID()) })
+		So(RegisterCodec(customCodec{}), ShouldEqual, ErrCodecRegistered)
+		decoded, err := decodeRecord(msg)
+		So(err, ShouldBeNil)
+		So(decoded, ShouldResemble, ServiceRecord{ID: "a", Address: "a"})
+	})
+}
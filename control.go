@@ -0,0 +1,166 @@
+package gopherdiscovery
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gdamore/mangos"
+	"github.com/gdamore/mangos/protocol/rep"
+	"github.com/gdamore/mangos/protocol/req"
+)
+
+// The control endpoint is a request/reply socket next to the Pub/Sub, the
+// subscribers use it to get the current membership before streaming the changes
+const (
+	opSnapshot = "snapshot"
+)
+
+// controlContext is signed with the replies of the control endpoint
+var controlContext = []byte("control")
+
+// DefaultSnapshotTimeout is the time a Subscriber waits for the snapshot of the membership
+const DefaultSnapshotTimeout = 1 * time.Second
+
+var ErrUnknownOperation = errors.New("Unknown operation on the control endpoint")
+
+type controlRequest struct {
+	Op string `json:"op"`
+	// Services to include in the snapshot, all of them if empty
+	Services []string `json:"services,omitempty"`
+}
+
+type controlReply struct {
+	Error  string `json:"error,omitempty"`
+	Update Update `json:"update"`
+}
+
+func listenControl(url string, opt TransportOptions) (mangos.Socket, error) {
+	var sock mangos.Socket
+	var err error
+
+	sock, err = rep.NewSocket()
+	if err != nil {
+		return nil, err
+	}
+	err = addTransports(sock, opt)
+	if err != nil {
+		sock.Close()
+		return nil, err
+	}
+
+	err = listen(sock, url, opt)
+	if err != nil {
+		sock.Close()
+		return nil, err
+	}
+	return sock, nil
+}
+
+func (d *DiscoveryServer) serveControl() {
+	var msg []byte
+	var err error
+	var backoff time.Duration
+
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		default:
+			msg, err = d.controlSock.Recv()
+			if err != nil {
+				if d.ctx.Err() == nil {
+					d.logger.Error("DiscoveryServer: Error reading the control request", "url", d.opt.ControlURL, "error", err)
+					backoff = nextBackoff(backoff)
+					sleep(d.ctx, backoff)
+				}
+				continue
+			}
+			backoff = 0
+
+			msg, err = encodeFrame(d.handleControl(msg))
+			if err != nil {
+				d.logger.Error("DiscoveryServer: Error encoding the control reply", "url", d.opt.ControlURL, "error", err)
+				continue
+			}
+			msg = signMessage(d.opt.SigningKey, controlContext, msg)
+			err = d.controlSock.Send(msg)
+			if err != nil {
+				d.logger.Error("DiscoveryServer: Error sending the control reply", "url", d.opt.ControlURL, "error", err)
+			}
+		}
+	}
+}
+
+func (d *DiscoveryServer) handleControl(msg []byte) controlReply {
+	var request controlRequest
+
+	err := decodeFrame(msg, &request)
+	if err != nil {
+		return controlReply{Error: err.Error()}
+	}
+
+	switch request.Op {
+	case opSnapshot:
+		return controlReply{Update: d.services.Snapshot(request.Services...)}
+	default:
+		return controlReply{Error: ErrUnknownOperation.Error()}
+	}
+}
+
+// fetchSnapshot asks the control endpoint for the current membership of the
+// subscribed services, or the whole membership if there are no services
+func fetchSnapshot(url string, opt SubscriberOptions) (Update, error) {
+	var sock mangos.Socket
+	var msg []byte
+	var reply controlReply
+	var err error
+
+	sock, err = req.NewSocket()
+	if err != nil {
+		return Update{}, err
+	}
+	defer sock.Close()
+
+	err = addTransports(sock, opt.Transport)
+	if err != nil {
+		return Update{}, err
+	}
+	timeout := opt.SnapshotTimeout
+	if timeout == 0 {
+		timeout = DefaultSnapshotTimeout
+	}
+	err = sock.SetOption(mangos.OptionRecvDeadline, timeout)
+	if err != nil {
+		return Update{}, err
+	}
+	err = dial(sock, url, opt.Transport)
+	if err != nil {
+		return Update{}, err
+	}
+
+	msg, err = encodeFrame(controlRequest{Op: opSnapshot, Services: opt.Services})
+	if err != nil {
+		return Update{}, err
+	}
+	err = sock.Send(msg)
+	if err != nil {
+		return Update{}, err
+	}
+	msg, err = sock.Recv()
+	if err != nil {
+		return Update{}, err
+	}
+	msg, err = verifyMessage(opt.PublicKey, controlContext, msg)
+	if err != nil {
+		return Update{}, err
+	}
+
+	err = decodeFrame(msg, &reply)
+	if err != nil {
+		return Update{}, err
+	}
+	if reply.Error != "" {
+		return Update{}, errors.New(reply.Error)
+	}
+	return reply.Update, nil
+}
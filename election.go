@@ -0,0 +1,291 @@
+package gopherdiscovery
+
+import (
+	"context"
+	"crypto/ed25519"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gdamore/mangos"
+	"github.com/gdamore/mangos/protocol/bus"
+)
+
+// DefaultHeartbeatTime is the time between heartbeats of the servers in the
+// election
+const DefaultHeartbeatTime = 1 * time.Second
+
+// The servers elect the leader with a bully algorithm over a bus socket:
+// every server sends heartbeats with its ID to the rest, and the alive server
+// with the highest ID is the leader. A server is gone when there are no
+// heartbeats from it during the election timeout, so a new leader takes over
+// in less than the election timeout plus a heartbeat. Only the servers ready
+// to lead run for leader, a server that is starting does not make the leader
+// step down before it can take over.
+//
+// The heartbeats are signed with the SharedKey of the servers, or with their
+// SigningKey if they have no SharedKey. Without any of them anyone reaching
+// the ElectionURL can take the leadership, the bus has to be a trusted
+// network.
+type election struct {
+	id string
+
+	heartbeat time.Duration
+	timeout   time.Duration
+
+	// keys of the heartbeats, they are not signed without keys
+	sharedKey  []byte
+	signingKey ed25519.PrivateKey
+
+	ctx    context.Context
+	sock   mangos.Socket
+	logger Logger
+
+	sync.Mutex
+	// last heartbeat from every server
+	peers  map[string]peer
+	leader string
+	// time of the last signed heartbeat of every server, the older ones are
+	// replayed
+	sent map[string]int64
+	// the server does not run for leader until it has listened to the rest
+	// of the servers for a whole election timeout
+	started time.Time
+	// set to 1 once the server has finished a SURVEY, it knows the
+	// membership
+	polled int32
+
+	// called every time the server becomes leader or stops being it
+	onChange func(leader bool)
+}
+
+type heartbeat struct {
+	ID string `json:"id"`
+	// Ready is set once the server can lead
+	Ready bool `json:"ready"`
+	// Sent is the time of the heartbeat in UnixNano
+	Sent int64 `json:"sent"`
+}
+
+// peer is the last heartbeat of another server
+type peer struct {
+	heard time.Time
+	ready bool
+}
+
+// heartbeatContext is signed with the heartbeats, so they can not be used as
+// any other signed message
+var heartbeatContext = []byte("gopherdiscovery: heartbeat")
+
+func newElection(ctx context.Context, opt Options, logger Logger, onChange func(leader bool)) (*election, error) {
+	var sock mangos.Socket
+	var err error
+
+	e := &election{
+		id:        opt.ServerID,
+		heartbeat: opt.HeartbeatTime,
+		timeout:   opt.ElectionTimeout,
+		ctx:       ctx,
+		logger:    logger,
+		peers:     make(map[string]peer),
+		sent:      make(map[string]int64),
+		started:   time.Now(),
+
+		sharedKey:  opt.SharedKey,
+		signingKey: opt.SigningKey,
+		onChange:   onChange,
+	}
+	if e.id == "" {
+		e.id = opt.ElectionURL
+	}
+	if e.heartbeat == 0 {
+		e.heartbeat = DefaultHeartbeatTime
+	}
+	if e.timeout == 0 {
+		e.timeout = 3 * e.heartbeat
+	}
+
+	sock, err = bus.NewSocket()
+	if err != nil {
+		return nil, err
+	}
+	err = addTransports(sock, opt.Transport)
+	if err != nil {
+		sock.Close()
+		return nil, err
+	}
+
+	err = listen(sock, opt.ElectionURL, opt.Transport)
+	if err != nil {
+		sock.Close()
+		return nil, err
+	}
+	for _, url := range opt.ElectionPeers {
+		err = dial(sock, url, opt.Transport)
+		if err != nil {
+			sock.Close()
+			return nil, err
+		}
+	}
+	// wakes up at least on every heartbeat
+	err = sock.SetOption(mangos.OptionRecvDeadline, e.heartbeat)
+	if err != nil {
+		sock.Close()
+		return nil, err
+	}
+
+	e.sock = sock
+	return e, nil
+}
+
+// Leader returns the ID of the current leader, empty while there is none
+func (e *election) Leader() string {
+	e.Lock()
+	defer e.Unlock()
+	return e.leader
+}
+
+func (e *election) run() {
+	var msg []byte
+	var hb heartbeat
+	var err error
+	var sent time.Time
+	var backoff time.Duration
+
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		default:
+			if time.Since(sent) >= e.heartbeat {
+				e.send()
+				sent = time.Now()
+				e.elect(sent)
+			}
+
+			msg, err = e.sock.Recv()
+			if err != nil {
+				if err != mangos.ErrRecvTimeout && e.ctx.Err() == nil {
+					e.logger.Error("DiscoveryServer: Error reading the election heartbeats", "id", e.id, "error", err)
+					backoff = nextBackoff(backoff)
+					sleep(e.ctx, backoff)
+				}
+				continue
+			}
+			backoff = 0
+			msg, err = e.verify(msg)
+			if err != nil {
+				e.logger.Warn("DiscoveryServer: Dropped forged election heartbeat", "id", e.id, "error", err)
+				continue
+			}
+			hb = heartbeat{}
+			err = decodeFrame(msg, &hb)
+			if err != nil {
+				e.logger.Warn("DiscoveryServer: Error decoding the election heartbeat", "id", e.id, "error", err)
+				continue
+			}
+			if hb.ID == e.id {
+				continue
+			}
+
+			if !e.heard(hb, time.Now()) {
+				e.logger.Warn("DiscoveryServer: Dropped replayed election heartbeat", "id", e.id, "peer", hb.ID)
+				continue
+			}
+			e.elect(time.Now())
+		}
+	}
+}
+
+// heard records the heartbeat of a peer, it reports false if the heartbeat is
+// signed and not newer than the last one
+func (e *election) heard(hb heartbeat, now time.Time) bool {
+	e.Lock()
+	defer e.Unlock()
+
+	if e.signed() {
+		if hb.Sent <= e.sent[hb.ID] {
+			return false
+		}
+		e.sent[hb.ID] = hb.Sent
+	}
+	e.peers[hb.ID] = peer{heard: now, ready: hb.Ready}
+	return true
+}
+
+// setPolled marks the server ready to lead once its startup is over
+func (e *election) setPolled() {
+	atomic.StoreInt32(&e.polled, 1)
+}
+
+// ready reports whether the server can lead, it knows the membership and has
+// listened to the rest of the servers for a whole election timeout
+func (e *election) ready(now time.Time) bool {
+	return atomic.LoadInt32(&e.polled) == 1 && now.Sub(e.started) >= e.timeout
+}
+
+func (e *election) signed() bool {
+	return len(e.sharedKey) > 0 || e.signingKey != nil
+}
+
+// sign signs the heartbeat with the SharedKey, or the SigningKey if there is
+// no SharedKey
+func (e *election) sign(frame []byte) []byte {
+	if len(e.sharedKey) > 0 {
+		return encodeSigned(responseMAC(e.sharedKey, heartbeatContext, frame), frame)
+	}
+	return signMessage(e.signingKey, heartbeatContext, frame)
+}
+
+// verify checks the signature of the heartbeat and returns the frame signed
+func (e *election) verify(msg []byte) ([]byte, error) {
+	if len(e.sharedKey) > 0 {
+		return verifyResponse(e.sharedKey, heartbeatContext, msg)
+	}
+	var key ed25519.PublicKey
+	if e.signingKey != nil {
+		key = e.signingKey.Public().(ed25519.PublicKey)
+	}
+	return verifyMessage(key, heartbeatContext, msg)
+}
+
+func (e *election) send() {
+	now := time.Now()
+	msg, err := encodeFrame(heartbeat{ID: e.id, Ready: e.ready(now), Sent: now.UnixNano()})
+	if err != nil {
+		e.logger.Error("DiscoveryServer: Error encoding the election heartbeat", "id", e.id, "error", err)
+		return
+	}
+	err = e.sock.Send(e.sign(msg))
+	if err != nil {
+		e.logger.Error("DiscoveryServer: Error sending the election heartbeat", "id", e.id, "error", err)
+	}
+}
+
+// elect chooses the alive server ready to lead with the highest ID
+func (e *election) elect(now time.Time) {
+	e.Lock()
+
+	leader := ""
+	if e.ready(now) {
+		leader = e.id
+	}
+	for id, p := range e.peers {
+		if now.Sub(p.heard) > e.timeout {
+			delete(e.peers, id)
+			continue
+		}
+		if p.ready && id > leader {
+			leader = id
+		}
+	}
+
+	was := e.leader == e.id
+	e.leader = leader
+	is := e.leader == e.id
+	e.Unlock()
+
+	if was != is {
+		e.onChange(is)
+	}
+}
@@ -0,0 +1,242 @@
+package gopherdiscovery
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gdamore/mangos/protocol/bus"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// waitFor polls the condition until it holds or the timeout expires
+func waitFor(timeout time.Duration, condition func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return condition()
+}
+
+func TestElection(t *testing.T) {
+	Convey("The servers elect one leader and a new one takes over when it is gone", t, func() {
+		elections := []string{"inproc://election/21", "inproc://election/22", "inproc://election/23"}
+		urlServers := []string{"inproc://survey/21", "inproc://survey/22", "inproc://survey/23"}
+		urlPubSubs := []string{"inproc://pubsub/21", "inproc://pubsub/22", "inproc://pubsub/23"}
+
+		var servers []*DiscoveryServer
+		var clientsUp []*DiscoveryClient
+		ctx, cancel := context.WithCancel(context.Background())
+		// also when an assertion fails, so the urls are free for the next run
+		Reset(func() {
+			for _, server := range servers {
+				server.Cancel()
+			}
+			cancel()
+			for _, client := range clientsUp {
+				client.Cancel()
+			}
+		})
+
+		for i, id := range []string{"a", "b", "c"} {
+			opts := defaultOpts
+			opts.MaxMissedSurveys = 2
+			opts.ElectionURL = elections[i]
+			opts.ServerID = id
+			opts.HeartbeatTime = 10 * time.Millisecond
+			opts.ElectionTimeout = 50 * time.Millisecond
+			for j, peer := range elections {
+				if j != i {
+					opts.ElectionPeers = append(opts.ElectionPeers, peer)
+				}
+			}
+
+			server, err := Server(urlServers[i], urlPubSubs[i], opts)
+			So(err, ShouldBeNil)
+			servers = append(servers, server)
+		}
+
+		sub, err := NewClusterSubscriber(ctx, urlPubSubs, SubscriberOptions{
+			Delivery:     LatestUpdate,
+			FailoverTime: 30 * time.Millisecond,
+		})
+		So(err, ShouldBeNil)
+
+		clientOne, err := ClusterClient(urlServers, nil, ServiceRecord{ID: "client1", Address: "client1"}, ClientOptions{})
+		So(err, ShouldBeNil)
+		clientsUp = append(clientsUp, clientOne)
+
+		So(waitFor(time.Second, servers[2].IsLeader), ShouldBeTrue)
+		So(servers[0].IsLeader(), ShouldBeFalse)
+		So(servers[1].IsLeader(), ShouldBeFalse)
+		So(servers[0].Leader(), ShouldEqual, "c")
+
+		clients := <-sub.Changes()
+		So(ids(clients), ShouldResemble, []string{"client1"})
+
+		servers[2].Cancel()
+		So(waitFor(200*time.Millisecond, servers[1].IsLeader), ShouldBeTrue)
+		So(servers[0].IsLeader(), ShouldBeFalse)
+
+		// the standbys surveyed the client too, the membership does not change
+		_, changed := changesWithin(sub.Changes(), 10*defaultOpts.PollTime)
+		So(changed, ShouldBeFalse)
+
+		// the new leader publishes the changes
+		clientTwo, err := ClusterClient(urlServers, nil, ServiceRecord{ID: "client2", Address: "client2"}, ClientOptions{})
+		So(err, ShouldBeNil)
+		clientsUp = append(clientsUp, clientTwo)
+		clients = <-sub.Changes()
+		So(ids(clients), ShouldResemble, []string{"client1", "client2"})
+	})
+}
+
+func TestElectionJoin(t *testing.T) {
+	Convey("A server with a higher ID joins without leaving the cluster without leader", t, func() {
+		elections := []string{"inproc://election/54", "inproc://election/55", "inproc://election/56"}
+		urlServers := []string{"inproc://survey/54", "inproc://survey/55", "inproc://survey/56"}
+		urlPubSubs := []string{"inproc://pubsub/54", "inproc://pubsub/55", "inproc://pubsub/56"}
+
+		var servers []*DiscoveryServer
+		var clients []*DiscoveryClient
+		ctx, cancel := context.WithCancel(context.Background())
+		Reset(func() {
+			for _, server := range servers {
+				server.Cancel()
+			}
+			cancel()
+			for _, client := range clients {
+				client.Cancel()
+			}
+		})
+
+		start := func(i int, opts Options) {
+			opts.MaxMissedSurveys = 2
+			opts.ElectionURL = elections[i]
+			opts.ServerID = []string{"a", "b", "c"}[i]
+			opts.HeartbeatTime = 10 * time.Millisecond
+			opts.ElectionTimeout = 50 * time.Millisecond
+			for j, peer := range elections {
+				if j != i {
+					opts.ElectionPeers = append(opts.ElectionPeers, peer)
+				}
+			}
+			server, err := Server(urlServers[i], urlPubSubs[i], opts)
+			So(err, ShouldBeNil)
+			servers = append(servers, server)
+		}
+		start(0, defaultOpts)
+		start(1, defaultOpts)
+
+		sub, err := NewClusterSubscriber(ctx, urlPubSubs, SubscriberOptions{
+			Delivery:     LatestUpdate,
+			FailoverTime: 30 * time.Millisecond,
+		})
+		So(err, ShouldBeNil)
+		client, err := ClusterClient(urlServers, nil, ServiceRecord{ID: "client1", Address: "client1"}, ClientOptions{})
+		So(err, ShouldBeNil)
+		clients = append(clients, client)
+
+		So(waitFor(time.Second, servers[1].IsLeader), ShouldBeTrue)
+		members := <-sub.Changes()
+		So(ids(members), ShouldResemble, []string{"client1"})
+
+		// c surveys for the first time after its ElectionTimeout, it does
+		// not lead before it knows the membership
+		opts := defaultOpts
+		opts.PollTime = 100 * time.Millisecond
+		start(2, opts)
+
+		var gap, longest time.Duration
+		last := time.Now()
+		for !servers[2].IsLeader() && time.Since(last) < time.Second {
+			now := time.Now()
+			if servers[1].IsLeader() {
+				gap = 0
+			} else {
+				gap += now.Sub(last)
+			}
+			if gap > longest {
+				longest = gap
+			}
+			last = now
+			time.Sleep(time.Millisecond)
+		}
+		So(servers[2].IsLeader(), ShouldBeTrue)
+		So(longest, ShouldBeLessThan, 10*time.Millisecond)
+
+		// c publishes the whole membership, nothing changes
+		_, changed := changesWithin(sub.Changes(), 10*defaultOpts.PollTime)
+		So(changed, ShouldBeFalse)
+	})
+}
+
+func TestElectionSigned(t *testing.T) {
+	Convey("The forged heartbeats do not take the leadership", t, func() {
+		opts := defaultOpts
+		opts.ElectionURL = "inproc://election/57"
+		opts.ServerID = "a"
+		opts.HeartbeatTime = 10 * time.Millisecond
+		opts.ElectionTimeout = 50 * time.Millisecond
+		opts.SharedKey = []byte("secret")
+		server, err := Server("inproc://survey/57", "inproc://pubsub/57", opts)
+		So(err, ShouldBeNil)
+		defer server.Cancel()
+		So(waitFor(time.Second, server.IsLeader), ShouldBeTrue)
+
+		sock, err := bus.NewSocket()
+		So(err, ShouldBeNil)
+		defer sock.Close()
+		So(addTransports(sock, TransportOptions{}), ShouldBeNil)
+		So(sock.Dial(opts.ElectionURL), ShouldBeNil)
+
+		for i := 0; i < 10; i++ {
+			msg, err := encodeFrame(heartbeat{ID: "zzzz", Ready: true, Sent: time.Now().UnixNano()})
+			So(err, ShouldBeNil)
+			So(sock.Send(msg), ShouldBeNil)
+			time.Sleep(opts.HeartbeatTime)
+		}
+		So(server.IsLeader(), ShouldBeTrue)
+		So(server.Leader(), ShouldEqual, "a")
+	})
+
+	Convey("The replayed heartbeats are dropped", t, func() {
+		e := &election{
+			id:        "a",
+			sharedKey: []byte("secret"),
+			peers:     make(map[string]peer),
+			sent:      make(map[string]int64),
+		}
+		now := time.Now()
+		hb := heartbeat{ID: "b", Ready: true, Sent: now.UnixNano()}
+
+		frame, err := encodeFrame(hb)
+		So(err, ShouldBeNil)
+		verified, err := e.verify(e.sign(frame))
+		So(err, ShouldBeNil)
+		So(verified, ShouldResemble, frame)
+		_, err = e.verify(frame)
+		So(err, ShouldEqual, ErrNotSigned)
+
+		So(e.heard(hb, now), ShouldBeTrue)
+		So(e.heard(hb, now), ShouldBeFalse)
+		hb.Sent++
+		So(e.heard(hb, now), ShouldBeTrue)
+	})
+}
+
+func TestWithoutElection(t *testing.T) {
+	Convey("Without election the server is always the leader", t, func() {
+		server, err := Server("inproc://survey/24", "inproc://pubsub/24", defaultOpts)
+		So(err, ShouldBeNil)
+
+		So(server.IsLeader(), ShouldBeTrue)
+		So(server.Leader(), ShouldEqual, "")
+
+		server.Cancel()
+	})
+}
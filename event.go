@@ -0,0 +1,99 @@
+package gopherdiscovery
+
+import "fmt"
+
+// EventType is the kind of change of a node in the membership
+type EventType int
+
+const (
+	// Added means a new node has been discovered
+	Added EventType = iota + 1
+	// Removed means the node is gone
+	Removed
+	// Updated means the node is still there but it advertises a different record
+	Updated
+)
+
+var eventNames = map[EventType]string{
+	Added:   "added",
+	Removed: "removed",
+	Updated: "updated",
+}
+
+func (t EventType) String() string {
+	if name, ok := eventNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+func (t EventType) MarshalText() ([]byte, error) {
+	err := checkEventType(t)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(t.String()), nil
+}
+
+// checkEventType returns an error if the event type is not known, the
+// decoders reject the events of unknown types
+func checkEventType(t EventType) error {
+	if _, ok := eventNames[t]; !ok {
+		return fmt.Errorf("Unknown event type %d", int(t))
+	}
+	return nil
+}
+
+func (t *EventType) UnmarshalText(text []byte) error {
+	for typ, name := range eventNames {
+		if name == string(text) {
+			*t = typ
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown event type %q", text)
+}
+
+// Event is a change of a single node in the membership
+type Event struct {
+	Type   EventType     `json:"type"`
+	Record ServiceRecord `json:"record"`
+	// Revision of the membership after the change, it increases monotonically
+	// on every published Update
+	Revision uint64 `json:"revision"`
+}
+
+// Update is published by the server every time the membership changes
+type Update struct {
+	// Origin identifies the server that computed the membership, revisions
+	// are only comparable within the same origin
+	Origin   string `json:"origin"`
+	Revision uint64 `json:"revision"`
+	// Records is the full membership after the change
+	Records []ServiceRecord `json:"records"`
+	// Events are the changes from the previous revision
+	Events []Event `json:"events"`
+}
+
+// diff computes the events to go from the previous to the current membership,
+// ordered by ID
+func diff(previous, current map[string]ServiceRecord, revision uint64) []Event {
+	var events []Event
+
+	before := recordIDs(previous)
+	after := recordIDs(current)
+
+	for _, r := range sortRecords(current) {
+		if !before.Contains(r.ID) {
+			events = append(events, Event{Type: Added, Record: r, Revision: revision})
+		} else if !previous[r.ID].Equal(r) {
+			events = append(events, Event{Type: Updated, Record: r, Revision: revision})
+		}
+	}
+	for _, r := range sortRecords(previous) {
+		if !after.Contains(r.ID) {
+			events = append(events, Event{Type: Removed, Record: r, Revision: revision})
+		}
+	}
+	return events
+}
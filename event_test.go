@@ -0,0 +1,47 @@
+package gopherdiscovery
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDiff(t *testing.T) {
+	Convey("Diff computes added, updated and removed nodes", t, func() {
+		previous := map[string]ServiceRecord{
+			"a": {ID: "a", Address: "a"},
+			"b": {ID: "b", Address: "b"},
+			"c": {ID: "c", Address: "c"},
+		}
+		current := map[string]ServiceRecord{
+			"a": {ID: "a", Address: "a"},
+			"b": {ID: "b", Address: "b2"},
+			"d": {ID: "d", Address: "d"},
+		}
+
+		events := diff(previous, current, 7)
+		So(events, ShouldResemble, []Event{
+			{Type: Updated, Record: current["b"], Revision: 7},
+			{Type: Added, Record: current["d"], Revision: 7},
+			{Type: Removed, Record: previous["c"], Revision: 7},
+		})
+	})
+
+	Convey("Diff is empty without changes", t, func() {
+		nodes := map[string]ServiceRecord{"a": {ID: "a", Address: "a"}}
+		So(diff(nodes, nodes, 1), ShouldBeEmpty)
+	})
+}
+
+func TestEventTypeText(t *testing.T) {
+	Convey("Event types are encoded as text", t, func() {
+		text, err := Removed.MarshalText()
+		So(err, ShouldBeNil)
+		So(string(text), ShouldEqual, "removed")
+
+		var typ EventType
+		So(typ.UnmarshalText([]byte("updated")), ShouldBeNil)
+		So(typ, ShouldEqual, Updated)
+		So(typ.UnmarshalText([]byte("unknown")), ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,15 @@
+module github.com/dahernan/gopherdiscovery
+
+go 1.21
+
+require (
+	github.com/gdamore/mangos v1.1.0
+	github.com/smartystreets/goconvey v1.6.4
+)
+
+require (
+	github.com/gopherjs/gopherjs v0.0.0-20181017120253-0766667cb4d1 // indirect
+	github.com/jtolds/gls v4.20.0+incompatible // indirect
+	github.com/smartystreets/assertions v0.0.0-20180927180507-b2de0cb4f26d // indirect
+	golang.org/x/net v0.0.0-20190311183353-d8887717615a // indirect
+)
@@ -0,0 +1,95 @@
+package gopherdiscovery
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+)
+
+// harnesses counts the harnesses started, so every one has its own urls
+var harnesses int64
+
+// Harness runs a server and its clients in the same process over the inproc
+// transport, tests get a discovery cluster without touching the network
+type Harness struct {
+	Server  *DiscoveryServer
+	Clients []*DiscoveryClient
+
+	URLServer  string
+	URLPubSub  string
+	URLControl string
+}
+
+// NewHarness starts a server and n clients with the IDs client1 ... clientN.
+// The server gets a ControlURL if opt has none.
+func NewHarness(n int, opt Options) (*Harness, error) {
+	var err error
+
+	prefix := fmt.Sprintf("inproc://gopherdiscovery/%d", atomic.AddInt64(&harnesses, 1))
+	if opt.ControlURL == "" {
+		opt.ControlURL = prefix + "/control"
+	}
+
+	h := &Harness{
+		URLServer:  prefix + "/survey",
+		URLPubSub:  prefix + "/pubsub",
+		URLControl: opt.ControlURL,
+	}
+
+	h.Server, err = Server(h.URLServer, h.URLPubSub, opt)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 1; i <= n; i++ {
+		id := fmt.Sprintf("client%d", i)
+		_, err = h.AddClient(ServiceRecord{ID: id, Address: id})
+		if err != nil {
+			h.Cancel()
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// AddClient starts one more client, its Peers are available
+func (h *Harness) AddClient(record ServiceRecord) (*DiscoveryClient, error) {
+	opt := ClientOptions{Subscriber: SubscriberOptions{ControlURLs: []string{h.URLControl}}}
+	client, err := ClientWithOptions(h.URLServer, h.URLPubSub, record, opt)
+	if err != nil {
+		return nil, err
+	}
+	h.Clients = append(h.Clients, client)
+	return client, nil
+}
+
+// Subscribe returns a new Subscriber of the server, it gets the current
+// membership first
+func (h *Harness) Subscribe(ctx context.Context, opt SubscriberOptions) (*Subscriber, error) {
+	if len(opt.ControlURLs) == 0 {
+		opt.ControlURLs = []string{h.URLControl}
+	}
+	return NewSubscriberWithOptions(ctx, h.URLPubSub, opt)
+}
+
+// Close shuts down all the clients and the server, and waits for their
+// goroutines
+func (h *Harness) Close() error {
+	var err error
+	for _, client := range h.Clients {
+		clientErr := client.Close()
+		if err == nil {
+			err = clientErr
+		}
+	}
+	serverErr := h.Server.Close()
+	if err == nil {
+		err = serverErr
+	}
+	return err
+}
+
+// Cancel shuts down all the clients and the server
+func (h *Harness) Cancel() {
+	h.Close()
+}
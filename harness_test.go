@@ -0,0 +1,49 @@
+package gopherdiscovery
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestHarness(t *testing.T) {
+	Convey("The harness runs a server and its clients in process", t, func() {
+		h, err := NewHarness(3, defaultOpts)
+		So(err, ShouldBeNil)
+		So(h.URLServer, ShouldStartWith, "inproc://")
+
+		peers, err := h.Clients[0].Peers()
+		So(err, ShouldBeNil)
+		clients := <-peers
+		for len(clients) < 3 {
+			clients = <-peers
+		}
+		So(ids(clients), ShouldResemble, []string{"client1", "client2", "client3"})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		sub, err := h.Subscribe(ctx, SubscriberOptions{})
+		So(err, ShouldBeNil)
+		clients = <-sub.Changes()
+		So(ids(clients), ShouldResemble, []string{"client1", "client2", "client3"})
+
+		_, err = h.AddClient(ServiceRecord{ID: "client4", Address: "client4"})
+		So(err, ShouldBeNil)
+		clients = <-sub.Changes()
+		So(ids(clients), ShouldResemble, []string{"client1", "client2", "client3", "client4"})
+
+		cancel()
+		h.Cancel()
+	})
+
+	Convey("Every harness has its own urls", t, func() {
+		one, err := NewHarness(1, defaultOpts)
+		So(err, ShouldBeNil)
+		two, err := NewHarness(1, defaultOpts)
+		So(err, ShouldBeNil)
+		So(one.URLServer, ShouldNotEqual, two.URLServer)
+
+		one.Cancel()
+		two.Cancel()
+	})
+}
@@ -0,0 +1,90 @@
+package gopherdiscovery
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// HealthStatus is the health of the service advertised by a node, empty if
+// the node has no health check
+type HealthStatus string
+
+const (
+	HealthPassing  HealthStatus = "passing"
+	HealthWarning  HealthStatus = "warning"
+	HealthCritical HealthStatus = "critical"
+)
+
+// DefaultHealthInterval is the time between health checks of a client
+const DefaultHealthInterval = 10 * time.Second
+
+// HealthCheck returns the health of the service advertised by the client
+type HealthCheck func() HealthStatus
+
+// HTTPCheck is passing while the url answers a GET with a 2xx status,
+// warning with 429 Too Many Requests and critical otherwise
+func HTTPCheck(url string, timeout time.Duration) HealthCheck {
+	client := &http.Client{Timeout: timeout}
+
+	return func() HealthStatus {
+		return httpCheck(context.Background(), client, url)
+	}
+}
+
+// httpCheck is critical too once the ctx is done
+func httpCheck(ctx context.Context, client *http.Client, url string) HealthStatus {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return HealthCritical
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return HealthCritical
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return HealthPassing
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return HealthWarning
+	default:
+		return HealthCritical
+	}
+}
+
+// TCPCheck is passing while a connection to the address can be opened
+func TCPCheck(address string, timeout time.Duration) HealthCheck {
+	return func() HealthStatus {
+		return tcpCheck(context.Background(), address, timeout)
+	}
+}
+
+// tcpCheck is critical too once the ctx is done
+func tcpCheck(ctx context.Context, address string, timeout time.Duration) HealthStatus {
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return HealthCritical
+	}
+	conn.Close()
+	return HealthPassing
+}
+
+// healthOrder ranks the health from the best to the worst
+var healthOrder = map[HealthStatus]int{
+	HealthPassing:  1,
+	HealthWarning:  2,
+	HealthCritical: 3,
+}
+
+// worstHealth returns the worst of the health reported by the node and the
+// one probed by the server
+func worstHealth(reported, probed HealthStatus) HealthStatus {
+	if healthOrder[probed] > healthOrder[reported] {
+		return probed
+	}
+	return reported
+}
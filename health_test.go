@@ -0,0 +1,43 @@
+package gopherdiscovery
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestHTTPCheck(t *testing.T) {
+	Convey("The HTTPCheck follows the status of the response", t, func() {
+		status := http.StatusOK
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		}))
+		check := HTTPCheck(server.URL, time.Second)
+
+		So(check(), ShouldEqual, HealthPassing)
+		status = http.StatusTooManyRequests
+		So(check(), ShouldEqual, HealthWarning)
+		status = http.StatusInternalServerError
+		So(check(), ShouldEqual, HealthCritical)
+
+		server.Close()
+		So(check(), ShouldEqual, HealthCritical)
+	})
+}
+
+func TestTCPCheck(t *testing.T) {
+	Convey("The TCPCheck is passing while the address accepts connections", t, func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		check := TCPCheck(listener.Addr().String(), time.Second)
+
+		So(check(), ShouldEqual, HealthPassing)
+
+		listener.Close()
+		So(check(), ShouldEqual, HealthCritical)
+	})
+}
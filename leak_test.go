@@ -0,0 +1,161 @@
+package gopherdiscovery
+
+import (
+	"context"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gdamore/mangos"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// packageGoroutines returns the stacks of the goroutines running the code of
+// the package by goroutine id. The goroutines of mangos alone are left out,
+// some of its pipes never stop their sender.
+func packageGoroutines() map[string]string {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+
+	stacks := make(map[string]string)
+	for _, stack := range strings.Split(string(buf), "\n\n") {
+		if !strings.Contains(stack, "gopherdiscovery.") || strings.Contains(stack, "gopherdiscovery.Test") {
+			continue
+		}
+		// goroutine 42 [chan receive]:
+		stacks[strings.Fields(stack)[1]] = stack
+	}
+	return stacks
+}
+
+// leakedGoroutines returns the stacks of the goroutines of the package that
+// were not running before
+func leakedGoroutines(before map[string]string) []string {
+	var leaked []string
+	for id, stack := range packageGoroutines() {
+		if _, ok := before[id]; !ok {
+			leaked = append(leaked, stack)
+		}
+	}
+	return leaked
+}
+
+// waitNoLeaks gives the goroutines some time to finish
+func waitNoLeaks(before map[string]string, timeout time.Duration) []string {
+	var leaked []string
+	waitFor(timeout, func() bool {
+		leaked = leakedGoroutines(before)
+		return len(leaked) == 0
+	})
+	return leaked
+}
+
+func TestCloseLeaks(t *testing.T) {
+	Convey("No goroutine is left after closing every component", t, func() {
+		before := packageGoroutines()
+
+		opts := defaultOpts
+		opts.ControlURL = "inproc://control/37"
+		opts.ElectionURL = "inproc://election/37"
+		opts.HeartbeatTime = 10 * time.Millisecond
+		opts.Prober = ProberFunc(func(r ServiceRecord) HealthStatus { return HealthPassing })
+		opts.ProbeInterval = 10 * time.Millisecond
+		server, err := Server("inproc://survey/37", "inproc://pubsub/37", opts)
+		So(err, ShouldBeNil)
+
+		client, err := ClientWithOptions("inproc://survey/37", "inproc://pubsub/37", ServiceRecord{ID: "a", Address: "a"},
+			ClientOptions{
+				Subscriber:     SubscriberOptions{ControlURLs: []string{opts.ControlURL}, Delivery: BlockingUpdates},
+				HealthCheck:    func() HealthStatus { return HealthPassing },
+				HealthInterval: 10 * time.Millisecond,
+			})
+		So(err, ShouldBeNil)
+		sub, err := NewSubscriberWithOptions(context.Background(), "inproc://pubsub/37", SubscriberOptions{})
+		So(err, ShouldBeNil)
+		publisher, err := NewPublisher(context.Background(), "inproc://pubsub/38")
+		So(err, ShouldBeNil)
+
+		peers, err := client.Peers()
+		So(err, ShouldBeNil)
+		clients := <-peers
+		for len(clients) == 0 {
+			clients = <-peers
+		}
+		So(ids(clients), ShouldResemble, []string{"a"})
+		publisher.Publish(Update{})
+
+		So(leakedGoroutines(before), ShouldNotBeEmpty)
+
+		// nobody reads the blocking updates of the client
+		So(client.Close(), ShouldBeNil)
+		So(sub.Close(), ShouldBeNil)
+		So(publisher.Close(), ShouldBeNil)
+		So(server.Close(), ShouldBeNil)
+
+		So(waitNoLeaks(before, time.Second), ShouldBeEmpty)
+
+		// closing again does nothing
+		So(client.Close(), ShouldBeNil)
+		So(sub.Close(), ShouldBeNil)
+		So(publisher.Close(), ShouldBeNil)
+		So(server.Close(), ShouldBeNil)
+
+		// the channels are closed once they are drained
+		for range sub.Changes() {
+		}
+		_, ok := <-sub.Events()
+		for ok {
+			_, ok = <-sub.Events()
+		}
+	})
+
+	Convey("Cancelling the context of a Subscriber also stops it", t, func() {
+		before := packageGoroutines()
+		ctx, cancel := context.WithCancel(context.Background())
+		sub, err := NewSubscriber(ctx, "inproc://pubsub/39")
+		So(err, ShouldBeNil)
+
+		cancel()
+		So(waitNoLeaks(before, time.Second), ShouldBeEmpty)
+		So(sub.Close(), ShouldBeNil)
+	})
+
+	Convey("The harness closes its server and clients", t, func() {
+		before := packageGoroutines()
+		h, err := NewHarness(2, defaultOpts)
+		So(err, ShouldBeNil)
+
+		So(h.Close(), ShouldBeNil)
+		So(waitNoLeaks(before, time.Second), ShouldBeEmpty)
+	})
+	Convey("A server that fails to start closes everything it opened", t, func() {
+		before := packageGoroutines()
+		opts := defaultOpts
+		opts.ControlURL = "inproc://control/49"
+		opts.ElectionURL = "inproc://election/49"
+		opts.AdminAddr = "invalid address"
+		_, err := Server("inproc://survey/49", "inproc://pubsub/49", opts)
+		So(err, ShouldNotBeNil)
+		So(waitNoLeaks(before, time.Second), ShouldBeEmpty)
+
+		// the urls are free again
+		opts.AdminAddr = ""
+		server, err := Server("inproc://survey/49", "inproc://pubsub/49", opts)
+		So(err, ShouldBeNil)
+		So(server.Close(), ShouldBeNil)
+	})
+
+	Convey("Close returns the errors closing the sockets", t, func() {
+		opts := defaultOpts
+		opts.ElectionURL = "inproc://election/48"
+		server, err := Server("inproc://survey/48", "inproc://pubsub/48", opts)
+		So(err, ShouldBeNil)
+
+		// both are closed again by their own goroutines
+		server.sock.Close()
+		server.election.sock.Close()
+		So(server.Close(), ShouldEqual, mangos.ErrClosed)
+	})
+}
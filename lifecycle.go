@@ -0,0 +1,78 @@
+package gopherdiscovery
+
+import (
+	"context"
+	"sync"
+
+	"github.com/gdamore/mangos"
+)
+
+// lifecycle runs the goroutines of a component until its context is done.
+// The sockets are closed once the context is done, that unblocks the pending
+// receives, and close waits for every goroutine to finish.
+type lifecycle struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// first error closing the sockets, every closeOnDone goroutine can set it
+	closeMutex sync.Mutex
+	closeErr   error
+}
+
+func (l *lifecycle) init(parent context.Context) {
+	l.ctx, l.cancel = context.WithCancel(parent)
+}
+
+func (l *lifecycle) goRun(fn func()) {
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		fn()
+	}()
+}
+
+// closeOnDone closes the sockets once the context is done
+func (l *lifecycle) closeOnDone(socks ...mangos.Socket) {
+	l.goRun(func() {
+		<-l.ctx.Done()
+		l.closeNow(socks...)
+	})
+}
+
+// closeNow closes the sockets and keeps the first error
+func (l *lifecycle) closeNow(socks ...mangos.Socket) {
+	for _, sock := range socks {
+		if sock == nil {
+			continue
+		}
+		err := sock.Close()
+		if err != nil {
+			l.closeMutex.Lock()
+			if l.closeErr == nil {
+				l.closeErr = err
+			}
+			l.closeMutex.Unlock()
+		}
+	}
+}
+
+// close cancels the context and waits for the goroutines, it can be called
+// many times
+func (l *lifecycle) close() error {
+	l.cancel()
+	l.wg.Wait()
+
+	l.closeMutex.Lock()
+	defer l.closeMutex.Unlock()
+	return l.closeErr
+}
+
+// closeSockets closes the sockets created before an error
+func closeSockets(socks ...mangos.Socket) {
+	for _, sock := range socks {
+		if sock != nil {
+			sock.Close()
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package gopherdiscovery
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Logger gets the messages of the servers, clients and subscribers. The args
+// are key value pairs, like in log/slog: "url", "error", "service"... The
+// repeated warnings and errors are rate limited, see RateLimit. The components
+// share the limits if they get the Logger of WithLogger or of RateLimit.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// SlogLogger logs to the slog.Logger, slog.Default() if nil
+func SlogLogger(l *slog.Logger) Logger {
+	if l == nil {
+		return slog.Default()
+	}
+	return l
+}
+
+// StdLogger logs to the log.Logger, log.Default() if nil. It is the Logger
+// used if there is none in the options.
+func StdLogger(l *log.Logger) Logger {
+	if l == nil {
+		l = log.Default()
+	}
+	return stdLogger{l}
+}
+
+type stdLogger struct {
+	l *log.Logger
+}
+
+func (s stdLogger) Debug(msg string, args ...any) { s.print("DEBUG", msg, args) }
+func (s stdLogger) Info(msg string, args ...any)  { s.print("INFO", msg, args) }
+func (s stdLogger) Warn(msg string, args ...any)  { s.print("WARN", msg, args) }
+func (s stdLogger) Error(msg string, args ...any) { s.print("ERROR", msg, args) }
+
+// print writes the level, the message and the fields as key=value
+func (s stdLogger) print(level string, msg string, args []any) {
+	var b strings.Builder
+	b.WriteString(level)
+	b.WriteString(" ")
+	b.WriteString(msg)
+	for i := 0; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			fmt.Fprintf(&b, " %v", args[i])
+			break
+		}
+		fmt.Fprintf(&b, " %v=%q", args[i], fmt.Sprint(args[i+1]))
+	}
+	s.l.Print(b.String())
+}
+
+// DefaultLogInterval is the time a repeated warning or error is not logged
+// again, the next one tells how many were suppressed
+const DefaultLogInterval = 10 * time.Second
+
+// RateLimit logs the same warning or error message at most once every
+// interval, a broken socket does not flood the logs. The messages are the same
+// if they have the same fields, the error apart. Once maxLimitedMessages are
+// limited, the fields of the new ones are ignored, so the fields sent by
+// other nodes do not grow the memory. Debug and Info are not limited.
+func RateLimit(l Logger, interval time.Duration) Logger {
+	return &limitedLogger{
+		Logger:   l,
+		interval: interval,
+		messages: make(map[string]*limitedMessage),
+	}
+}
+
+// maxLimitedMessages is the number of messages a RateLimit Logger tracks
+const maxLimitedMessages = 1000
+
+type limitedLogger struct {
+	Logger
+	interval time.Duration
+
+	mutex    sync.Mutex
+	messages map[string]*limitedMessage
+}
+
+type limitedMessage struct {
+	logged     time.Time
+	suppressed int
+}
+
+func (l *limitedLogger) Warn(msg string, args ...any) {
+	if args, ok := l.allow(msg, args, time.Now()); ok {
+		l.Logger.Warn(msg, args...)
+	}
+}
+
+func (l *limitedLogger) Error(msg string, args ...any) {
+	if args, ok := l.allow(msg, args, time.Now()); ok {
+		l.Logger.Error(msg, args...)
+	}
+}
+
+// allow reports if the message can be logged, the args get the number of
+// messages suppressed since the last time
+func (l *limitedLogger) allow(msg string, args []any, now time.Time) ([]any, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	key := messageKey(msg, args)
+	m, ok := l.messages[key]
+	if !ok && len(l.messages) >= maxLimitedMessages {
+		l.expire(now)
+		if len(l.messages) >= maxLimitedMessages {
+			key = msg
+			m, ok = l.messages[key]
+		}
+	}
+	if !ok {
+		l.messages[key] = &limitedMessage{logged: now}
+		return args, true
+	}
+	if now.Sub(m.logged) < l.interval {
+		m.suppressed++
+		return args, false
+	}
+	if m.suppressed > 0 {
+		args = append(args[:len(args):len(args)], "suppressed", m.suppressed)
+	}
+	m.logged = now
+	m.suppressed = 0
+	return args, true
+}
+
+// expire forgets the messages not logged in the last interval
+func (l *limitedLogger) expire(now time.Time) {
+	for key, m := range l.messages {
+		if now.Sub(m.logged) >= l.interval {
+			delete(l.messages, key)
+		}
+	}
+}
+
+// messageKey identifies the message by its text and its fields, the error
+// changes between the repetitions of the same failure
+func messageKey(msg string, args []any) string {
+	var b strings.Builder
+	b.WriteString(msg)
+	for i := 0; i+1 < len(args); i += 2 {
+		if args[i] == "error" {
+			continue
+		}
+		fmt.Fprintf(&b, " %v=%q", args[i], fmt.Sprint(args[i+1]))
+	}
+	return b.String()
+}
+
+// newLogger returns the rate limited Logger of a component
+func newLogger(l Logger) Logger {
+	if _, ok := l.(*limitedLogger); ok {
+		return l
+	}
+	if l == nil {
+		l = StdLogger(nil)
+	}
+	return RateLimit(l, DefaultLogInterval)
+}
+
+const (
+	minBackoff = 10 * time.Millisecond
+	maxBackoff = time.Second
+)
+
+// nextBackoff doubles the time to wait after a failed receive up to maxBackoff
+func nextBackoff(backoff time.Duration) time.Duration {
+	if backoff == 0 {
+		return minBackoff
+	}
+	if backoff*2 > maxBackoff {
+		return maxBackoff
+	}
+	return backoff * 2
+}
+
+// sleep waits the backoff, it returns early once the context is done
+func sleep(ctx context.Context, backoff time.Duration) {
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
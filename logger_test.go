@@ -0,0 +1,162 @@
+package gopherdiscovery
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// recordLogger keeps the messages logged
+type recordLogger struct {
+	sync.Mutex
+	messages []string
+	args     [][]any
+}
+
+func (r *recordLogger) Debug(msg string, args ...any) { r.log(msg, args) }
+func (r *recordLogger) Info(msg string, args ...any)  { r.log(msg, args) }
+func (r *recordLogger) Warn(msg string, args ...any)  { r.log(msg, args) }
+func (r *recordLogger) Error(msg string, args ...any) { r.log(msg, args) }
+
+func (r *recordLogger) log(msg string, args []any) {
+	r.Lock()
+	defer r.Unlock()
+	r.messages = append(r.messages, msg)
+	r.args = append(r.args, args)
+}
+
+func (r *recordLogger) count(msg string) int {
+	r.Lock()
+	defer r.Unlock()
+	n := 0
+	for _, m := range r.messages {
+		if m == msg {
+			n++
+		}
+	}
+	return n
+}
+
+func TestLoggers(t *testing.T) {
+	Convey("The StdLogger writes the level, the message and the fields", t, func() {
+		var buf bytes.Buffer
+		logger := StdLogger(log.New(&buf, "", 0))
+
+		logger.Warn("DiscoveryServer: Rejected SURVEY response", "url", "inproc://survey", "error", ErrBadSignature)
+		So(buf.String(), ShouldEqual,
+			"WARN DiscoveryServer: Rejected SURVEY response url=\"inproc://survey\" error=\""+ErrBadSignature.Error()+"\"\n")
+	})
+
+	Convey("The SlogLogger uses the slog handler", t, func() {
+		var buf bytes.Buffer
+		logger := SlogLogger(slog.New(slog.NewTextHandler(&buf, nil)))
+
+		logger.Error("DiscoveryClient: Cannot receive the SURVEY", "id", "client1")
+		So(buf.String(), ShouldContainSubstring, "level=ERROR")
+		So(buf.String(), ShouldContainSubstring, "id=client1")
+		So(SlogLogger(nil), ShouldEqual, slog.Default())
+	})
+
+	Convey("The repeated errors are rate limited", t, func() {
+		rec := &recordLogger{}
+		logger := RateLimit(rec, time.Second).(*limitedLogger)
+		now := time.Now()
+
+		args, ok := logger.allow("broken", []any{"error", "closed"}, now)
+		So(ok, ShouldBeTrue)
+		So(args, ShouldResemble, []any{"error", "closed"})
+
+		_, ok = logger.allow("broken", nil, now.Add(100*time.Millisecond))
+		So(ok, ShouldBeFalse)
+		_, ok = logger.allow("broken", nil, now.Add(200*time.Millisecond))
+		So(ok, ShouldBeFalse)
+		_, ok = logger.allow("other", nil, now.Add(200*time.Millisecond))
+		So(ok, ShouldBeTrue)
+
+		args, ok = logger.allow("broken", []any{"error", "closed"}, now.Add(time.Second))
+		So(ok, ShouldBeTrue)
+		So(args, ShouldResemble, []any{"error", "closed", "suppressed", 2})
+
+		logger.Info("started")
+		logger.Info("started")
+		So(rec.count("started"), ShouldEqual, 2)
+		So(newLogger(logger), ShouldEqual, logger)
+	})
+
+	Convey("The limits are by fields and shared by the components of a Logger", t, func() {
+		rec := &recordLogger{}
+		s := newSettings([]Option{WithLogger(rec)})
+		logger := s.server.Logger.(*limitedLogger)
+		So(s.client.Logger, ShouldEqual, logger)
+		So(s.client.Subscriber.Logger, ShouldEqual, logger)
+		now := time.Now()
+
+		_, ok := logger.allow("denied", []any{"id", "a", "error", "full"}, now)
+		So(ok, ShouldBeTrue)
+		_, ok = logger.allow("denied", []any{"id", "b", "error", "full"}, now)
+		So(ok, ShouldBeTrue)
+		_, ok = logger.allow("denied", []any{"id", "a", "error", "timeout"}, now)
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("The fields sent by other nodes do not grow the limited messages", t, func() {
+		logger := RateLimit(&recordLogger{}, time.Second).(*limitedLogger)
+		now := time.Now()
+
+		for i := 0; i < 3*maxLimitedMessages; i++ {
+			logger.allow("denied", []any{"id", fmt.Sprint(i)}, now)
+		}
+		So(len(logger.messages), ShouldBeLessThanOrEqualTo, maxLimitedMessages+1)
+		_, ok := logger.allow("denied", []any{"id", "new"}, now)
+		So(ok, ShouldBeFalse)
+
+		// the old ones expire
+		_, ok = logger.allow("denied", []any{"id", "new"}, now.Add(time.Second))
+		So(ok, ShouldBeTrue)
+		So(len(logger.messages), ShouldEqual, 1)
+	})
+
+	Convey("The backoff doubles up to the maximum", t, func() {
+		backoff := nextBackoff(0)
+		So(backoff, ShouldEqual, minBackoff)
+		So(nextBackoff(backoff), ShouldEqual, 2*minBackoff)
+		So(nextBackoff(maxBackoff), ShouldEqual, maxBackoff)
+	})
+}
+
+func TestServerLogger(t *testing.T) {
+	Convey("The server logs the rejected responses once in the interval", t, func() {
+		urlServ := "inproc://survey/42"
+		urlPubSub := "inproc://pubsub/42"
+		rec := &recordLogger{}
+		ctx, cancel := context.WithCancel(context.Background())
+
+		server, err := NewServer(ctx, urlServ, urlPubSub, WithOptions(defaultOpts),
+			WithSharedKey([]byte("secret")), WithLogger(rec))
+		So(err, ShouldBeNil)
+
+		client, err := ClientWithOptions(urlServ, "", ServiceRecord{ID: "client1", Address: "client1"},
+			ClientOptions{SharedKey: []byte("guess"), LeaveTimeout: time.Millisecond})
+		So(err, ShouldBeNil)
+
+		for server.Rejected() < 5 {
+			time.Sleep(defaultOpts.PollTime)
+		}
+		So(rec.count("DiscoveryServer: Rejected SURVEY response"), ShouldEqual, 1)
+
+		rec.Lock()
+		So(rec.args[0][:2], ShouldResemble, []any{"url", urlServ})
+		rec.Unlock()
+
+		client.Close()
+		cancel()
+		So(server.Close(), ShouldBeNil)
+	})
+}
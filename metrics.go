@@ -0,0 +1,232 @@
+package gopherdiscovery
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Metrics gets the measures of the servers, clients and subscribers, the
+// names are the Metric constants. Add increases a counter, Set changes a gauge
+// and Observe adds a sample to a histogram.
+type Metrics interface {
+	Add(name string, value float64)
+	Set(name string, value float64)
+	Observe(name string, value float64)
+}
+
+// Metrics of the server
+const (
+	// MetricSurveyRounds counts the SURVEYS sent
+	MetricSurveyRounds = "gopherdiscovery_survey_rounds_total"
+	// MetricSurveyResponses is the number of responses of the last SURVEY
+	MetricSurveyResponses = "gopherdiscovery_survey_responses"
+	// MetricSurveyLatency is the time since the SURVEY until every response
+	MetricSurveyLatency = "gopherdiscovery_survey_latency_seconds"
+	// MetricMembers is the number of nodes in the membership
+	MetricMembers = "gopherdiscovery_members"
+	// MetricNodesAdded counts the nodes added to the membership
+	MetricNodesAdded = "gopherdiscovery_nodes_added_total"
+	// MetricNodesRemoved counts the nodes removed from the membership
+	MetricNodesRemoved = "gopherdiscovery_nodes_removed_total"
+	// MetricPublishErrors counts the publications that could not be sent
+	MetricPublishErrors = "gopherdiscovery_publish_errors_total"
+)
+
+// Metrics of the clients and subscribers
+const (
+	// MetricSurveysAnswered counts the SURVEY responses sent by the client
+	MetricSurveysAnswered = "gopherdiscovery_surveys_answered_total"
+	// MetricUpdatesReceived counts the publications accepted by the Subscriber
+	MetricUpdatesReceived = "gopherdiscovery_updates_received_total"
+	// MetricUpdatesDropped counts the memberships the consumer missed
+	// because Changes was full
+	MetricUpdatesDropped = "gopherdiscovery_updates_dropped_total"
+)
+
+var metricHelp = map[string]string{
+	MetricSurveyRounds:    "SURVEYS sent by the server.",
+	MetricSurveyResponses: "Responses to the last SURVEY.",
+	MetricSurveyLatency:   "Time between the SURVEY and every response.",
+	MetricMembers:         "Nodes in the membership.",
+	MetricNodesAdded:      "Nodes added to the membership.",
+	MetricNodesRemoved:    "Nodes removed from the membership.",
+	MetricPublishErrors:   "Publications that could not be sent.",
+	MetricSurveysAnswered: "SURVEY responses sent by the client.",
+	MetricUpdatesReceived: "Publications accepted by the subscriber.",
+	MetricUpdatesDropped:  "Memberships dropped because the consumer was not ready.",
+}
+
+// noMetrics discards the measures when there are no Metrics in the options
+type noMetrics struct{}
+
+func (noMetrics) Add(name string, value float64)     {}
+func (noMetrics) Set(name string, value float64)     {}
+func (noMetrics) Observe(name string, value float64) {}
+
+func orNoMetrics(m Metrics) Metrics {
+	if m == nil {
+		return noMetrics{}
+	}
+	return m
+}
+
+// DefaultBuckets are the upper bounds in seconds of the histogram buckets of
+// the PrometheusMetrics
+var DefaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// PrometheusMetrics keeps the measures in memory and writes them in the
+// Prometheus text format, it is an http.Handler to serve them on /metrics
+type PrometheusMetrics struct {
+	buckets []float64
+
+	mutex      sync.Mutex
+	counters   map[string]float64
+	gauges     map[string]float64
+	histograms map[string]*histogram
+}
+
+type histogram struct {
+	// counts of every bucket, the last one is +Inf
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewPrometheusMetrics returns the metrics with the buckets of the
+// histograms, DefaultBuckets if there are none
+func NewPrometheusMetrics(buckets ...float64) *PrometheusMetrics {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+
+	return &PrometheusMetrics{
+		buckets:    buckets,
+		counters:   make(map[string]float64),
+		gauges:     make(map[string]float64),
+		histograms: make(map[string]*histogram),
+	}
+}
+
+func (p *PrometheusMetrics) Add(name string, value float64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.counters[name] += value
+}
+
+func (p *PrometheusMetrics) Set(name string, value float64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.gauges[name] = value
+}
+
+func (p *PrometheusMetrics) Observe(name string, value float64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	h, ok := p.histograms[name]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(p.buckets)+1)}
+		p.histograms[name] = h
+	}
+	i := sort.SearchFloat64s(p.buckets, value)
+	h.counts[i]++
+	h.sum += value
+	h.count++
+}
+
+// WriteTo writes the metrics in the Prometheus text format, sorted by name
+func (p *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	cw := &countWriter{w: bufio.NewWriter(w)}
+	for _, name := range sortedKeys(p.counters) {
+		writeHeader(cw, name, "counter")
+		fmt.Fprintf(cw, "%s %s\n", name, formatFloat(p.counters[name]))
+	}
+	for _, name := range sortedKeys(p.gauges) {
+		writeHeader(cw, name, "gauge")
+		fmt.Fprintf(cw, "%s %s\n", name, formatFloat(p.gauges[name]))
+	}
+
+	names := make([]string, 0, len(p.histograms))
+	for name := range p.histograms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		h := p.histograms[name]
+		writeHeader(cw, name, "histogram")
+		// the buckets are cumulative
+		var cumulative uint64
+		for i, bound := range p.buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(cw, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(cw, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+		fmt.Fprintf(cw, "%s_sum %s\n", name, formatFloat(h.sum))
+		fmt.Fprintf(cw, "%s_count %d\n", name, h.count)
+	}
+
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+	return cw.n, cw.w.Flush()
+}
+
+// ServeHTTP serves the metrics to the Prometheus scrapes
+func (p *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	p.WriteTo(w)
+}
+
+func writeHeader(w io.Writer, name string, kind string) {
+	if help, ok := metricHelp[name]; ok {
+		fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	}
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// countWriter counts the bytes written and keeps the first error
+type countWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (c *countWriter) Write(b []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
@@ -0,0 +1,104 @@
+package gopherdiscovery
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	Convey("The metrics are written in the Prometheus text format", t, func() {
+		metrics := NewPrometheusMetrics(0.1, 0.01)
+		metrics.Add(MetricSurveyRounds, 1)
+		metrics.Add(MetricSurveyRounds, 2)
+		metrics.Set(MetricMembers, 4)
+		metrics.Observe(MetricSurveyLatency, 0.005)
+		metrics.Observe(MetricSurveyLatency, 0.05)
+		metrics.Observe(MetricSurveyLatency, 0.5)
+
+		var buf bytes.Buffer
+		n, err := metrics.WriteTo(&buf)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, buf.Len())
+		So(buf.String(), ShouldEqual, `# HELP gopherdiscovery_survey_rounds_total SURVEYS sent by the server.
+# TYPE gopherdiscovery_survey_rounds_total counter
+gopherdiscovery_survey_rounds_total 3
+# HELP gopherdiscovery_members Nodes in the membership.
+# TYPE gopherdiscovery_members gauge
+gopherdiscovery_members 4
+# HELP gopherdiscovery_survey_latency_seconds Time between the SURVEY and every response.
+# TYPE gopherdiscovery_survey_latency_seconds histogram
+gopherdiscovery_survey_latency_seconds_bucket{le="0.01"} 1
+gopherdiscovery_survey_latency_seconds_bucket{le="0.1"} 2
+gopherdiscovery_survey_latency_seconds_bucket{le="+Inf"} 3
+gopherdiscovery_survey_latency_seconds_sum 0.555
+gopherdiscovery_survey_latency_seconds_count 3
+`)
+
+		rec := httptest.NewRecorder()
+		metrics.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		So(rec.Header().Get("Content-Type"), ShouldStartWith, "text/plain")
+		So(rec.Body.String(), ShouldEqual, buf.String())
+	})
+
+	Convey("The Subscriber counts the memberships dropped", t, func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		metrics := NewPrometheusMetrics()
+		s := newSubscriber(ctx, nil, SubscriberOptions{Delivery: DropUpdates, Metrics: metrics})
+
+		for i := 1; i <= 20; i++ {
+			s.deliver(updateWith(uint64(i), i))
+		}
+		So(metrics.counters[MetricUpdatesDropped], ShouldEqual, 20-cap(s.changes))
+	})
+}
+
+func TestServerMetrics(t *testing.T) {
+	Convey("The server, the client and the subscriber report their metrics", t, func() {
+		urlServ := "inproc://survey/43"
+		urlPubSub := "inproc://pubsub/43"
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		serverMetrics := NewPrometheusMetrics()
+		server, err := NewServer(ctx, urlServ, urlPubSub, WithOptions(defaultOpts), WithMetrics(serverMetrics))
+		So(err, ShouldBeNil)
+
+		clientMetrics := NewPrometheusMetrics()
+		sub, err := Subscribe(ctx, []string{urlPubSub}, WithMetrics(clientMetrics))
+		So(err, ShouldBeNil)
+		client, err := NewClient(ctx, []string{urlServ}, nil, ServiceRecord{ID: "client1", Address: "client1"},
+			WithMetrics(clientMetrics))
+		So(err, ShouldBeNil)
+
+		clients := <-sub.Changes()
+		So(ids(clients), ShouldResemble, []string{"client1"})
+
+		So(client.Close(), ShouldBeNil)
+		clients = <-sub.Changes()
+		So(clients, ShouldBeEmpty)
+		So(server.Close(), ShouldBeNil)
+		So(sub.Close(), ShouldBeNil)
+
+		var buf bytes.Buffer
+		serverMetrics.WriteTo(&buf)
+		out := buf.String()
+		So(out, ShouldContainSubstring, "gopherdiscovery_nodes_added_total 1\n")
+		So(out, ShouldContainSubstring, "gopherdiscovery_nodes_removed_total 1\n")
+		So(out, ShouldContainSubstring, "gopherdiscovery_members 0\n")
+		So(out, ShouldContainSubstring, "gopherdiscovery_survey_rounds_total")
+		So(out, ShouldContainSubstring, "gopherdiscovery_survey_latency_seconds_count")
+		So(strings.Contains(out, MetricPublishErrors), ShouldBeFalse)
+
+		buf.Reset()
+		clientMetrics.WriteTo(&buf)
+		out = buf.String()
+		So(out, ShouldContainSubstring, "gopherdiscovery_updates_received_total 2\n")
+		So(out, ShouldContainSubstring, "gopherdiscovery_surveys_answered_total")
+	})
+}
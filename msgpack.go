@@ -0,0 +1,460 @@
+package gopherdiscovery
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+)
+
+// msgpackCodec encodes the records and updates as msgpack maps with the same
+// keys as JSON, the event types are the names used by JSON too
+type msgpackCodec struct{}
+
+var ErrInvalidMsgpack = errors.New("Invalid msgpack message")
+
+func (msgpackCodec) ID() byte {
+	return formatMsgpack
+}
+
+func (msgpackCodec) EncodeRecord(r ServiceRecord) ([]byte, error) {
+	return mpAppendRecord(nil, r), nil
+}
+
+func (msgpackCodec) DecodeRecord(payload []byte) (ServiceRecord, error) {
+	v, err := mpDecode(payload)
+	if err != nil {
+		return ServiceRecord{}, err
+	}
+	return mpRecord(v)
+}
+
+func (msgpackCodec) EncodeUpdate(u Update) ([]byte, error) {
+	var msg []byte
+
+	msg = mpAppendMapHeader(msg, 4)
+	msg = mpAppendString(msg, "origin")
+	msg = mpAppendString(msg, u.Origin)
+	msg = mpAppendString(msg, "revision")
+	msg = mpAppendUint(msg, u.Revision)
+	msg = mpAppendString(msg, "records")
+	msg = mpAppendArrayHeader(msg, len(u.Records))
+	for _, r := range u.Records {
+		msg = mpAppendRecord(msg, r)
+	}
+	msg = mpAppendString(msg, "events")
+	msg = mpAppendArrayHeader(msg, len(u.Events))
+	for _, e := range u.Events {
+		name, err := e.Type.MarshalText()
+		if err != nil {
+			return nil, err
+		}
+		msg = mpAppendMapHeader(msg, 3)
+		msg = mpAppendString(msg, "type")
+		msg = mpAppendString(msg, string(name))
+		msg = mpAppendString(msg, "record")
+		msg = mpAppendRecord(msg, e.Record)
+		msg = mpAppendString(msg, "revision")
+		msg = mpAppendUint(msg, e.Revision)
+	}
+	return msg, nil
+}
+
+func (msgpackCodec) DecodeUpdate(payload []byte) (Update, error) {
+	var u Update
+
+	v, err := mpDecode(payload)
+	if err != nil {
+		return u, err
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return u, ErrInvalidMsgpack
+	}
+	u.Origin, _ = m["origin"].(string)
+	u.Revision = mpUint(m["revision"])
+
+	records, _ := m["records"].([]interface{})
+	for _, item := range records {
+		r, err := mpRecord(item)
+		if err != nil {
+			return u, err
+		}
+		u.Records = append(u.Records, r)
+	}
+
+	events, _ := m["events"].([]interface{})
+	for _, item := range events {
+		em, ok := item.(map[string]interface{})
+		if !ok {
+			return u, ErrInvalidMsgpack
+		}
+		var e Event
+		name, _ := em["type"].(string)
+		err = e.Type.UnmarshalText([]byte(name))
+		if err != nil {
+			return u, err
+		}
+		e.Record, err = mpRecord(em["record"])
+		if err != nil {
+			return u, err
+		}
+		e.Revision = mpUint(em["revision"])
+		u.Events = append(u.Events, e)
+	}
+	return u, nil
+}
+
+// mpAppendRecord appends the record as a map, the empty fields are left out
+// like in JSON
+func mpAppendRecord(msg []byte, r ServiceRecord) []byte {
+	fields := 2
+	for _, empty := range []bool{r.Service == "", r.Version == "", len(r.Tags) == 0, len(r.Metadata) == 0, r.Health == ""} {
+		if !empty {
+			fields++
+		}
+	}
+
+	msg = mpAppendMapHeader(msg, fields)
+	msg = mpAppendString(msg, "id")
+	msg = mpAppendString(msg, r.ID)
+	msg = mpAppendString(msg, "address")
+	msg = mpAppendString(msg, r.Address)
+	if r.Service != "" {
+		msg = mpAppendString(msg, "service")
+		msg = mpAppendString(msg, r.Service)
+	}
+	if r.Version != "" {
+		msg = mpAppendString(msg, "version")
+		msg = mpAppendString(msg, r.Version)
+	}
+	if len(r.Tags) > 0 {
+		msg = mpAppendString(msg, "tags")
+		msg = mpAppendArrayHeader(msg, len(r.Tags))
+		for _, tag := range r.Tags {
+			msg = mpAppendString(msg, tag)
+		}
+	}
+	if len(r.Metadata) > 0 {
+		keys := make([]string, 0, len(r.Metadata))
+		for key := range r.Metadata {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		msg = mpAppendString(msg, "metadata")
+		msg = mpAppendMapHeader(msg, len(keys))
+		for _, key := range keys {
+			msg = mpAppendString(msg, key)
+			msg = mpAppendString(msg, r.Metadata[key])
+		}
+	}
+	if r.Health != "" {
+		msg = mpAppendString(msg, "health")
+		msg = mpAppendString(msg, string(r.Health))
+	}
+	return msg
+}
+
+func mpRecord(v interface{}) (ServiceRecord, error) {
+	var r ServiceRecord
+
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return r, ErrInvalidMsgpack
+	}
+	r.ID, _ = m["id"].(string)
+	r.Address, _ = m["address"].(string)
+	r.Service, _ = m["service"].(string)
+	r.Version, _ = m["version"].(string)
+	health, _ := m["health"].(string)
+	r.Health = HealthStatus(health)
+
+	tags, _ := m["tags"].([]interface{})
+	for _, tag := range tags {
+		s, ok := tag.(string)
+		if !ok {
+			return r, ErrInvalidMsgpack
+		}
+		r.Tags = append(r.Tags, s)
+	}
+
+	metadata, _ := m["metadata"].(map[string]interface{})
+	for key, value := range metadata {
+		s, ok := value.(string)
+		if !ok {
+			return r, ErrInvalidMsgpack
+		}
+		if r.Metadata == nil {
+			r.Metadata = make(map[string]string)
+		}
+		r.Metadata[key] = s
+	}
+	return r, nil
+}
+
+// mpUint returns the unsigned integer, other encoders may use the signed
+// formats for positive integers
+func mpUint(v interface{}) uint64 {
+	switch n := v.(type) {
+	case uint64:
+		return n
+	case int64:
+		if n >= 0 {
+			return uint64(n)
+		}
+	}
+	return 0
+}
+
+func mpAppendMapHeader(msg []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(msg, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		msg = append(msg, 0xde)
+		return binary.BigEndian.AppendUint16(msg, uint16(n))
+	default:
+		msg = append(msg, 0xdf)
+		return binary.BigEndian.AppendUint32(msg, uint32(n))
+	}
+}
+
+func mpAppendArrayHeader(msg []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(msg, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		msg = append(msg, 0xdc)
+		return binary.BigEndian.AppendUint16(msg, uint16(n))
+	default:
+		msg = append(msg, 0xdd)
+		return binary.BigEndian.AppendUint32(msg, uint32(n))
+	}
+}
+
+func mpAppendString(msg []byte, s string) []byte {
+	n := len(s)
+	switch {
+	case n < 32:
+		msg = append(msg, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		msg = append(msg, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		msg = append(msg, 0xda)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(n))
+	default:
+		msg = append(msg, 0xdb)
+		msg = binary.BigEndian.AppendUint32(msg, uint32(n))
+	}
+	return append(msg, s...)
+}
+
+func mpAppendUint(msg []byte, v uint64) []byte {
+	switch {
+	case v < 128:
+		return append(msg, byte(v))
+	case v <= math.MaxUint8:
+		return append(msg, 0xcc, byte(v))
+	case v <= math.MaxUint16:
+		msg = append(msg, 0xcd)
+		return binary.BigEndian.AppendUint16(msg, uint16(v))
+	case v <= math.MaxUint32:
+		msg = append(msg, 0xce)
+		return binary.BigEndian.AppendUint32(msg, uint32(v))
+	default:
+		msg = append(msg, 0xcf)
+		return binary.BigEndian.AppendUint64(msg, v)
+	}
+}
+
+// mpDecode decodes the whole message. Maps are map[string]interface{},
+// arrays []interface{}, strings and binaries string, the positive integers
+// uint64 and the negative ones int64.
+func mpDecode(msg []byte) (interface{}, error) {
+	d := mpDecoder{msg: msg}
+	v, err := d.value()
+	if err != nil {
+		return nil, err
+	}
+	if len(d.msg) > 0 {
+		return nil, ErrInvalidMsgpack
+	}
+	return v, nil
+}
+
+// mpMaxDepth is the maximum nesting of arrays and maps, the messages come
+// from the network and a deep nesting would exhaust the stack
+const mpMaxDepth = 16
+
+type mpDecoder struct {
+	msg []byte
+	// nesting of the array or map being decoded
+	depth int
+}
+
+func (d *mpDecoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.msg) < n {
+		return nil, ErrInvalidMsgpack
+	}
+	b := d.msg[:n]
+	d.msg = d.msg[n:]
+	return b, nil
+}
+
+// readUint reads a big endian unsigned integer of n bytes
+func (d *mpDecoder) readUint(n int) (uint64, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+func (d *mpDecoder) value() (interface{}, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	c := b[0]
+
+	switch {
+	case c <= 0x7f:
+		return uint64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return d.mapOf(int(c & 0x0f))
+	case c&0xf0 == 0x90:
+		return d.arrayOf(int(c & 0x0f))
+	case c&0xe0 == 0xa0:
+		return d.stringOf(int(c & 0x1f))
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xd9:
+		return d.sized(1, d.stringOf)
+	case 0xc5, 0xda:
+		return d.sized(2, d.stringOf)
+	case 0xc6, 0xdb:
+		return d.sized(4, d.stringOf)
+	case 0xca:
+		v, err := d.readUint(4)
+		return float64(math.Float32frombits(uint32(v))), err
+	case 0xcb:
+		v, err := d.readUint(8)
+		return math.Float64frombits(v), err
+	case 0xcc:
+		return d.readUint(1)
+	case 0xcd:
+		return d.readUint(2)
+	case 0xce:
+		return d.readUint(4)
+	case 0xcf:
+		return d.readUint(8)
+	case 0xd0:
+		v, err := d.readUint(1)
+		return int64(int8(v)), err
+	case 0xd1:
+		v, err := d.readUint(2)
+		return int64(int16(v)), err
+	case 0xd2:
+		v, err := d.readUint(4)
+		return int64(int32(v)), err
+	case 0xd3:
+		v, err := d.readUint(8)
+		return int64(v), err
+	case 0xdc:
+		return d.sized(2, d.arrayOf)
+	case 0xdd:
+		return d.sized(4, d.arrayOf)
+	case 0xde:
+		return d.sized(2, d.mapOf)
+	case 0xdf:
+		return d.sized(4, d.mapOf)
+	}
+	return nil, ErrInvalidMsgpack
+}
+
+// sized reads the length in n bytes and then the value of that length
+func (d *mpDecoder) sized(n int, fn func(int) (interface{}, error)) (interface{}, error) {
+	length, err := d.readUint(n)
+	if err != nil {
+		return nil, err
+	}
+	if length > uint64(len(d.msg)) {
+		// every element takes at least a byte
+		return nil, ErrInvalidMsgpack
+	}
+	return fn(int(length))
+}
+
+func (d *mpDecoder) stringOf(n int) (interface{}, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// nested enters an array or map, it fails beyond mpMaxDepth
+func (d *mpDecoder) nested() error {
+	d.depth++
+	if d.depth > mpMaxDepth {
+		return ErrInvalidMsgpack
+	}
+	return nil
+}
+
+func (d *mpDecoder) arrayOf(n int) (interface{}, error) {
+	err := d.nested()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { d.depth-- }()
+
+	var items []interface{}
+	for i := 0; i < n; i++ {
+		v, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, v)
+	}
+	return items, nil
+}
+
+func (d *mpDecoder) mapOf(n int) (interface{}, error) {
+	err := d.nested()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { d.depth-- }()
+
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, ErrInvalidMsgpack
+		}
+		m[key], err = d.value()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
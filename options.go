@@ -0,0 +1,169 @@
+package gopherdiscovery
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"time"
+
+	"github.com/gdamore/mangos"
+)
+
+// Option configures the components created by NewServer, NewClient and
+// Subscribe. The options that do not apply to a component are ignored, so
+// the same options can be shared by all of them.
+type Option func(*settings)
+
+type settings struct {
+	server Options
+	client ClientOptions
+}
+
+func newSettings(opts []Option) settings {
+	var s settings
+	for _, opt := range opts {
+		opt(&s)
+	}
+	return s
+}
+
+// WithOptions sets the options of the server, the options after it change them
+func WithOptions(opt Options) Option {
+	return func(s *settings) {
+		s.server = opt
+	}
+}
+
+// WithClientOptions sets the options of the client, the options after it
+// change them
+func WithClientOptions(opt ClientOptions) Option {
+	return func(s *settings) {
+		s.client = opt
+	}
+}
+
+// WithSubscriberOptions sets the options of the Subscriber of the client or
+// of Subscribe
+func WithSubscriberOptions(opt SubscriberOptions) Option {
+	return func(s *settings) {
+		s.client.Subscriber = opt
+	}
+}
+
+// WithTLS sets the TLSConfig of every socket
+func WithTLS(config *tls.Config) Option {
+	return func(s *settings) {
+		s.server.Transport.TLSConfig = config
+		s.client.Transport.TLSConfig = config
+		s.client.Subscriber.Transport.TLSConfig = config
+	}
+}
+
+// WithTransports replaces the supported transports of every socket
+func WithTransports(transports ...mangos.Transport) Option {
+	return func(s *settings) {
+		s.server.Transport.Transports = transports
+		s.client.Transport.Transports = transports
+		s.client.Subscriber.Transport.Transports = transports
+	}
+}
+
+// WithCodec sets the Codec of the publications of the server and of the
+// SURVEY responses of the client
+func WithCodec(codec Codec) Option {
+	return func(s *settings) {
+		s.server.Codec = codec
+		s.client.Codec = codec
+	}
+}
+
+// WithSharedKey sets the key that authenticates the SURVEY responses
+func WithSharedKey(key []byte) Option {
+	return func(s *settings) {
+		s.server.SharedKey = key
+		s.client.SharedKey = key
+	}
+}
+
+// WithSigningKey sets the key the server signs the publications with
+func WithSigningKey(key ed25519.PrivateKey) Option {
+	return func(s *settings) {
+		s.server.SigningKey = key
+	}
+}
+
+// WithPublicKey sets the key the subscribers verify the publications with
+func WithPublicKey(key ed25519.PublicKey) Option {
+	return func(s *settings) {
+		s.client.Subscriber.PublicKey = key
+	}
+}
+
+// WithControlURL sets the ControlURL of the server, and adds it to the
+// ControlURLs of the subscribers
+func WithControlURL(url string) Option {
+	return func(s *settings) {
+		s.server.ControlURL = url
+		s.client.Subscriber.ControlURLs = append(s.client.Subscriber.ControlURLs, url)
+	}
+}
+
+// WithServices subscribes only to the changes of the services
+func WithServices(services ...string) Option {
+	return func(s *settings) {
+		s.client.Subscriber.Services = services
+	}
+}
+
+// WithHealthCheck sets the HealthCheck of the client, it runs every interval
+// or DefaultHealthInterval if 0
+func WithHealthCheck(check HealthCheck, interval time.Duration) Option {
+	return func(s *settings) {
+		s.client.HealthCheck = check
+		s.client.HealthInterval = interval
+	}
+}
+
+// WithLogger sets the Logger of every component, they share its rate limits
+func WithLogger(logger Logger) Option {
+	logger = newLogger(logger)
+	return func(s *settings) {
+		s.server.Logger = logger
+		s.client.Logger = logger
+		s.client.Subscriber.Logger = logger
+	}
+}
+
+// WithMetrics sets the Metrics of every component
+func WithMetrics(metrics Metrics) Option {
+	return func(s *settings) {
+		s.server.Metrics = metrics
+		s.client.Metrics = metrics
+		s.client.Subscriber.Metrics = metrics
+	}
+}
+
+// WithAdminAddr serves the HTTP admin API of the server on the address
+func WithAdminAddr(addr string) Option {
+	return func(s *settings) {
+		s.server.AdminAddr = addr
+	}
+}
+
+// NewServer starts a server that runs until it is closed or ctx is done
+func NewServer(ctx context.Context, urlServer string, urlPubSub string, opts ...Option) (*DiscoveryServer, error) {
+	return newServer(ctx, urlServer, urlPubSub, newSettings(opts).server)
+}
+
+// NewClient starts a client of every server that runs until it is closed or
+// ctx is done, then it leaves the cluster. The Peers are available if there
+// are urlPubSubs.
+func NewClient(ctx context.Context, urlServers []string, urlPubSubs []string, record ServiceRecord, opts ...Option) (*DiscoveryClient, error) {
+	return newClient(ctx, urlServers, urlPubSubs, record, newSettings(opts).client)
+}
+
+// Subscribe subscribes to the Pub/Sub of every server until the Subscriber
+// is closed or ctx is done
+func Subscribe(ctx context.Context, urlPubSubs []string, opts ...Option) (*Subscriber, error) {
+	return NewClusterSubscriber(ctx, urlPubSubs, subscriberOptions(newSettings(opts).client))
+}
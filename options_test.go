@@ -0,0 +1,86 @@
+package gopherdiscovery
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gdamore/mangos/transport/inproc"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestContextConstructors(t *testing.T) {
+	Convey("The components stop when the context of the caller is done", t, func() {
+		urlServ := "inproc://survey/40"
+		urlPubSub := "inproc://pubsub/40"
+		urlControl := "inproc://control/40"
+		opts := defaultOpts
+		opts.MaxMissedSurveys = 1000
+
+		serverCtx, cancelServer := context.WithCancel(context.Background())
+		server, err := NewServer(serverCtx, urlServ, urlPubSub, WithOptions(opts), WithControlURL(urlControl),
+			WithSharedKey([]byte("secret")), WithCodec(MsgpackCodec))
+		So(err, ShouldBeNil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		sub, err := Subscribe(ctx, []string{urlPubSub}, WithControlURL(urlControl))
+		So(err, ShouldBeNil)
+
+		clientCtx, cancelClient := context.WithCancel(context.Background())
+		client, err := NewClient(clientCtx, []string{urlServ}, []string{urlPubSub},
+			ServiceRecord{ID: "client1", Address: "client1"}, WithSharedKey([]byte("secret")), WithCodec(MsgpackCodec))
+		So(err, ShouldBeNil)
+
+		clients := <-sub.Changes()
+		for len(clients) == 0 {
+			clients = <-sub.Changes()
+		}
+		So(ids(clients), ShouldResemble, []string{"client1"})
+
+		// the client leaves the cluster, it is not removed for missing the
+		// SURVEYS
+		cancelClient()
+		clients, ok := changesWithin(sub.Changes(), 10*opts.PollTime)
+		So(ok, ShouldBeTrue)
+		So(clients, ShouldBeEmpty)
+		_, ok = <-client.servers[0].done
+		So(ok, ShouldBeFalse)
+		So(client.Close(), ShouldBeNil)
+
+		cancelServer()
+		server.Wait()
+		So(server.Close(), ShouldBeNil)
+
+		cancel()
+		So(sub.Close(), ShouldBeNil)
+	})
+}
+
+func TestOptions(t *testing.T) {
+	Convey("The options apply to every component", t, func() {
+		s := newSettings([]Option{
+			WithOptions(defaultOpts),
+			WithClientOptions(ClientOptions{LeaveTimeout: time.Second}),
+			WithCodec(ProtobufCodec),
+			WithServices("cache"),
+		})
+		So(s.server.PollTime, ShouldEqual, defaultOpts.PollTime)
+		So(s.server.Codec.ID(), ShouldEqual, ProtobufCodec.ID())
+		So(s.client.LeaveTimeout, ShouldEqual, time.Second)
+		So(s.client.Codec.ID(), ShouldEqual, ProtobufCodec.ID())
+		So(s.client.Subscriber.Services, ShouldResemble, []string{"cache"})
+	})
+
+	Convey("Only the given transports are supported", t, func() {
+		ctx := context.Background()
+		_, err := NewServer(ctx, "tcp://127.0.0.1:40041", "inproc://pubsub/41",
+			WithOptions(defaultOpts), WithTransports(inproc.NewTransport()))
+		So(err, ShouldNotBeNil)
+
+		server, err := NewServer(ctx, "inproc://survey/41", "inproc://pubsub/41",
+			WithOptions(defaultOpts), WithTransports(inproc.NewTransport()))
+		So(err, ShouldBeNil)
+		So(server.Close(), ShouldBeNil)
+	})
+}
@@ -0,0 +1,156 @@
+package gopherdiscovery
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultProbeInterval is the time between the probes of every node
+	DefaultProbeInterval = 10 * time.Second
+	// DefaultProbeConcurrency is the number of nodes probed at the same time
+	DefaultProbeConcurrency = 8
+	// DefaultProbeTimeout is the time a probe waits for the service
+	DefaultProbeTimeout = 2 * time.Second
+)
+
+// Prober checks from the server the service advertised by a node, a hung
+// process can answer the SURVEYS but not the probes
+type Prober interface {
+	Probe(r ServiceRecord) HealthStatus
+}
+
+// ContextProber is a Prober that gives up once the ctx is done, the server
+// cancels the probes when it is closed
+type ContextProber interface {
+	Prober
+	ProbeContext(ctx context.Context, r ServiceRecord) HealthStatus
+}
+
+// ProberFunc is a function used as Prober
+type ProberFunc func(r ServiceRecord) HealthStatus
+
+func (f ProberFunc) Probe(r ServiceRecord) HealthStatus {
+	return f(r)
+}
+
+// HTTPProber sends a GET to the Path of the Address, http is used if the
+// Address has no scheme. It is critical unless the response is a 2xx, or
+// warning if it is 429 Too Many Requests
+type HTTPProber struct {
+	Path string
+	// Timeout of the request, DefaultProbeTimeout if 0
+	Timeout time.Duration
+}
+
+func (p HTTPProber) Probe(r ServiceRecord) HealthStatus {
+	return p.ProbeContext(context.Background(), r)
+}
+
+func (p HTTPProber) ProbeContext(ctx context.Context, r ServiceRecord) HealthStatus {
+	address := r.Address
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+	client := &http.Client{Timeout: probeTimeout(p.Timeout)}
+	return httpCheck(ctx, client, strings.TrimSuffix(address, "/")+p.Path)
+}
+
+// TCPProber opens a connection to the host and port of the Address, the
+// Address can be host:port or an url with a port
+type TCPProber struct {
+	// Timeout of the connection, DefaultProbeTimeout if 0
+	Timeout time.Duration
+}
+
+func (p TCPProber) Probe(r ServiceRecord) HealthStatus {
+	return p.ProbeContext(context.Background(), r)
+}
+
+func (p TCPProber) ProbeContext(ctx context.Context, r ServiceRecord) HealthStatus {
+	address := r.Address
+	if strings.Contains(address, "://") {
+		u, err := url.Parse(address)
+		if err != nil {
+			return HealthCritical
+		}
+		address = u.Host
+	}
+	return tcpCheck(ctx, address, probeTimeout(p.Timeout))
+}
+
+func probeTimeout(timeout time.Duration) time.Duration {
+	if timeout == 0 {
+		return DefaultProbeTimeout
+	}
+	return timeout
+}
+
+// probe checks every node at most ProbeConcurrency at the same time, and
+// updates the membership with the results. Once the server is closed no more
+// nodes are probed and the results are dropped.
+func (d *DiscoveryServer) probe() {
+	concurrency := d.opt.ProbeConcurrency
+	if concurrency <= 0 {
+		concurrency = DefaultProbeConcurrency
+	}
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	probed := make(map[string]HealthStatus)
+	limit := make(chan struct{}, concurrency)
+
+probing:
+	for _, record := range d.services.probeTargets() {
+		select {
+		case limit <- struct{}{}:
+		case <-d.ctx.Done():
+			break probing
+		}
+		wg.Add(1)
+		go func(record ServiceRecord) {
+			defer wg.Done()
+			defer func() { <-limit }()
+
+			health := d.probeNode(record)
+			mutex.Lock()
+			probed[record.ID] = health
+			mutex.Unlock()
+		}(record)
+	}
+	wg.Wait()
+
+	if d.ctx.Err() != nil {
+		return
+	}
+	d.services.SetProbed(probed)
+}
+
+func (d *DiscoveryServer) probeNode(record ServiceRecord) HealthStatus {
+	if prober, ok := d.opt.Prober.(ContextProber); ok {
+		return prober.ProbeContext(d.ctx, record)
+	}
+	return d.opt.Prober.Probe(record)
+}
+
+func (d *DiscoveryServer) runProbes() {
+	interval := d.opt.ProbeInterval
+	if interval == 0 {
+		interval = DefaultProbeInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-ticker.C:
+			d.probe()
+		}
+	}
+}
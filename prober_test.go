@@ -0,0 +1,93 @@
+package gopherdiscovery
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestHTTPProber(t *testing.T) {
+	Convey("The HTTPProber gets the path of the advertised address", t, func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/health" {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		defer server.Close()
+
+		prober := HTTPProber{Path: "/health", Timeout: time.Second}
+		So(prober.Probe(ServiceRecord{Address: server.URL}), ShouldEqual, HealthPassing)
+		So(prober.Probe(ServiceRecord{Address: server.URL + "/"}), ShouldEqual, HealthPassing)
+		So(prober.Probe(ServiceRecord{Address: strings.TrimPrefix(server.URL, "http://")}), ShouldEqual, HealthPassing)
+		So(HTTPProber{Path: "/other"}.Probe(ServiceRecord{Address: server.URL}), ShouldEqual, HealthCritical)
+	})
+}
+
+func TestTCPProber(t *testing.T) {
+	Convey("The TCPProber connects to the advertised address", t, func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		address := listener.Addr().String()
+
+		prober := TCPProber{Timeout: time.Second}
+		So(prober.Probe(ServiceRecord{Address: address}), ShouldEqual, HealthPassing)
+		So(prober.Probe(ServiceRecord{Address: "tcp://" + address}), ShouldEqual, HealthPassing)
+
+		listener.Close()
+		So(prober.Probe(ServiceRecord{Address: address}), ShouldEqual, HealthCritical)
+	})
+}
+
+func TestProbesStopOnClose(t *testing.T) {
+	Convey("Closing the server does not wait for the probes of every node", t, func() {
+		probed := make(chan struct{}, 1)
+		release := make(chan struct{})
+		hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case probed <- struct{}{}:
+			default:
+			}
+			select {
+			case <-r.Context().Done():
+			case <-release:
+			}
+		}))
+		defer hung.Close()
+		defer close(release)
+
+		opts := defaultOpts
+		opts.Prober = HTTPProber{Path: "/health"}
+		opts.ProbeInterval = 10 * time.Millisecond
+		opts.ProbeConcurrency = 1
+		server, err := Server("inproc://survey/50", "inproc://pubsub/50", opts)
+		So(err, ShouldBeNil)
+
+		nodes := make(map[string]ServiceRecord)
+		for i := 0; i < 10; i++ {
+			id := fmt.Sprintf("client%d", i)
+			nodes[id] = ServiceRecord{ID: id, Address: hung.URL}
+		}
+		server.services.Add(nodes)
+		<-probed
+
+		start := time.Now()
+		So(server.Close(), ShouldBeNil)
+		So(time.Since(start), ShouldBeLessThan, DefaultProbeTimeout)
+	})
+}
+
+func TestWorstHealth(t *testing.T) {
+	Convey("The published health is the worst of the reported and the probed", t, func() {
+		So(worstHealth("", ""), ShouldEqual, HealthStatus(""))
+		So(worstHealth("", HealthPassing), ShouldEqual, HealthPassing)
+		So(worstHealth(HealthWarning, HealthPassing), ShouldEqual, HealthWarning)
+		So(worstHealth(HealthWarning, HealthCritical), ShouldEqual, HealthCritical)
+		So(worstHealth(HealthCritical, ""), ShouldEqual, HealthCritical)
+	})
+}
@@ -0,0 +1,259 @@
+package gopherdiscovery
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+// protobufCodec encodes the messages of gopherdiscovery.proto without
+// generated code
+type protobufCodec struct{}
+
+var ErrInvalidProtobuf = errors.New("Invalid protobuf message")
+
+// protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// field numbers of gopherdiscovery.proto
+const (
+	pbRecordID       = 1
+	pbRecordAddress  = 2
+	pbRecordService  = 3
+	pbRecordVersion  = 4
+	pbRecordTags     = 5
+	pbRecordMetadata = 6
+	pbRecordHealth   = 7
+
+	pbEntryKey   = 1
+	pbEntryValue = 2
+
+	pbEventType     = 1
+	pbEventRecord   = 2
+	pbEventRevision = 3
+
+	pbUpdateOrigin   = 1
+	pbUpdateRevision = 2
+	pbUpdateRecords  = 3
+	pbUpdateEvents   = 4
+)
+
+func (protobufCodec) ID() byte {
+	return formatProtobuf
+}
+
+func (protobufCodec) EncodeRecord(r ServiceRecord) ([]byte, error) {
+	return pbAppendRecord(nil, r), nil
+}
+
+func (protobufCodec) DecodeRecord(payload []byte) (ServiceRecord, error) {
+	return pbDecodeRecord(payload)
+}
+
+func (protobufCodec) EncodeUpdate(u Update) ([]byte, error) {
+	var msg []byte
+
+	msg = pbAppendString(msg, pbUpdateOrigin, u.Origin)
+	msg = pbAppendUint(msg, pbUpdateRevision, u.Revision)
+	for _, r := range u.Records {
+		msg = pbAppendBytes(msg, pbUpdateRecords, pbAppendRecord(nil, r))
+	}
+	for _, e := range u.Events {
+		var event []byte
+		event = pbAppendUint(event, pbEventType, uint64(e.Type))
+		event = pbAppendBytes(event, pbEventRecord, pbAppendRecord(nil, e.Record))
+		event = pbAppendUint(event, pbEventRevision, e.Revision)
+		msg = pbAppendBytes(msg, pbUpdateEvents, event)
+	}
+	return msg, nil
+}
+
+func (protobufCodec) DecodeUpdate(payload []byte) (Update, error) {
+	var u Update
+
+	err := pbFields(payload, func(field int, value uint64, data []byte) error {
+		var err error
+		switch field {
+		case pbUpdateOrigin:
+			u.Origin = string(data)
+		case pbUpdateRevision:
+			u.Revision = value
+		case pbUpdateRecords:
+			var r ServiceRecord
+			r, err = pbDecodeRecord(data)
+			u.Records = append(u.Records, r)
+		case pbUpdateEvents:
+			var e Event
+			e, err = pbDecodeEvent(data)
+			u.Events = append(u.Events, e)
+		}
+		return err
+	})
+	return u, err
+}
+
+func pbAppendRecord(msg []byte, r ServiceRecord) []byte {
+	msg = pbAppendString(msg, pbRecordID, r.ID)
+	msg = pbAppendString(msg, pbRecordAddress, r.Address)
+	msg = pbAppendString(msg, pbRecordService, r.Service)
+	msg = pbAppendString(msg, pbRecordVersion, r.Version)
+	for _, tag := range r.Tags {
+		msg = pbAppendBytes(msg, pbRecordTags, []byte(tag))
+	}
+
+	// sorted keys, so the same record is always the same message
+	keys := make([]string, 0, len(r.Metadata))
+	for key := range r.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var entry []byte
+		entry = pbAppendString(entry, pbEntryKey, key)
+		entry = pbAppendString(entry, pbEntryValue, r.Metadata[key])
+		msg = pbAppendBytes(msg, pbRecordMetadata, entry)
+	}
+	return pbAppendString(msg, pbRecordHealth, string(r.Health))
+}
+
+func pbDecodeRecord(payload []byte) (ServiceRecord, error) {
+	var r ServiceRecord
+
+	err := pbFields(payload, func(field int, value uint64, data []byte) error {
+		switch field {
+		case pbRecordID:
+			r.ID = string(data)
+		case pbRecordAddress:
+			r.Address = string(data)
+		case pbRecordService:
+			r.Service = string(data)
+		case pbRecordVersion:
+			r.Version = string(data)
+		case pbRecordTags:
+			r.Tags = append(r.Tags, string(data))
+		case pbRecordMetadata:
+			var key, value string
+			err := pbFields(data, func(field int, _ uint64, data []byte) error {
+				switch field {
+				case pbEntryKey:
+					key = string(data)
+				case pbEntryValue:
+					value = string(data)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if r.Metadata == nil {
+				r.Metadata = make(map[string]string)
+			}
+			r.Metadata[key] = value
+		case pbRecordHealth:
+			r.Health = HealthStatus(data)
+		}
+		return nil
+	})
+	return r, err
+}
+
+func pbDecodeEvent(payload []byte) (Event, error) {
+	var e Event
+
+	err := pbFields(payload, func(field int, value uint64, data []byte) error {
+		var err error
+		switch field {
+		case pbEventType:
+			e.Type = EventType(value)
+		case pbEventRecord:
+			e.Record, err = pbDecodeRecord(data)
+		case pbEventRevision:
+			e.Revision = value
+		}
+		return err
+	})
+	if err != nil {
+		return e, err
+	}
+	// also without the type, it is omitted when 0
+	return e, checkEventType(e.Type)
+}
+
+// pbAppendString appends the field, empty strings are the default value and
+// they are not encoded
+func pbAppendString(msg []byte, field int, s string) []byte {
+	if s == "" {
+		return msg
+	}
+	return pbAppendBytes(msg, field, []byte(s))
+}
+
+func pbAppendBytes(msg []byte, field int, data []byte) []byte {
+	msg = binary.AppendUvarint(msg, uint64(field)<<3|wireBytes)
+	msg = binary.AppendUvarint(msg, uint64(len(data)))
+	return append(msg, data...)
+}
+
+func pbAppendUint(msg []byte, field int, value uint64) []byte {
+	if value == 0 {
+		return msg
+	}
+	msg = binary.AppendUvarint(msg, uint64(field)<<3|wireVarint)
+	return binary.AppendUvarint(msg, value)
+}
+
+// pbFields calls fn for every field of the message with the value of the
+// varints or the data of the length delimited fields. Fields of other wire
+// types are skipped.
+func pbFields(msg []byte, fn func(field int, value uint64, data []byte) error) error {
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return ErrInvalidProtobuf
+		}
+		msg = msg[n:]
+
+		var value uint64
+		var data []byte
+		switch key & 7 {
+		case wireVarint:
+			value, n = binary.Uvarint(msg)
+			if n <= 0 {
+				return ErrInvalidProtobuf
+			}
+			msg = msg[n:]
+		case wireBytes:
+			length, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < length {
+				return ErrInvalidProtobuf
+			}
+			data = msg[n : n+int(length)]
+			msg = msg[n+int(length):]
+		case wireFixed64:
+			if len(msg) < 8 {
+				return ErrInvalidProtobuf
+			}
+			msg = msg[8:]
+			continue
+		case wireFixed32:
+			if len(msg) < 4 {
+				return ErrInvalidProtobuf
+			}
+			msg = msg[4:]
+			continue
+		default:
+			return ErrInvalidProtobuf
+		}
+
+		err := fn(int(key>>3), value, data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
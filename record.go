@@ -0,0 +1,259 @@
+package gopherdiscovery
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Wire format of the messages exchanged between clients and servers.
+// Every message starts with a two bytes header: the version of the wire
+// protocol and the format used to encode the payload, that is the ID of the
+// Codec for the records and updates.
+const (
+	wireVersion byte = 1
+
+	formatJSON     byte = 1
+	formatProtobuf byte = 2
+	formatMsgpack  byte = 3
+
+	headerLen = 2
+)
+
+// A client leaving the cluster answers the SURVEY with its record after
+// leaveVersion: [leaveVersion][frame]
+const leaveVersion byte = 3
+
+// Publications start with a topic, so subscribers only get the services they
+// are interested in. The topic ends with topicEnd, that can not be part of a
+// service name.
+const (
+	allTopic      = "all"
+	servicePrefix = "svc:"
+	topicEnd      = 0
+)
+
+// The old publishers sent the membership as the addresses joined with
+// legacySeparator, without topic nor header. They are decoded during the
+// migration as coming from legacyOrigin.
+const (
+	legacySeparator = "|"
+	legacyOrigin    = "legacy"
+)
+
+var (
+	ErrUnknownWireVersion = errors.New("Unknown wire version of the message")
+	ErrUnknownFormat      = errors.New("Unknown format of the message")
+	ErrMissingTopic       = errors.New("The publication has no topic")
+)
+
+// ServiceRecord is what every node advertises when it answers a SURVEY
+type ServiceRecord struct {
+	// ID identifies the node, the server tracks the membership by ID
+	ID string `json:"id"`
+	// Address where the service can be reached, for example
+	// http://192.168.1.1:8080
+	Address string `json:"address"`
+	// Service name, for example api, cache or worker
+	Service string `json:"service,omitempty"`
+	// Version of the service
+	Version string `json:"version,omitempty"`
+	// Tags and Metadata are free form information about the node
+	Tags     []string          `json:"tags,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Health of the service, empty if the node has no health check
+	Health HealthStatus `json:"health,omitempty"`
+}
+
+// Equal reports whether both records advertise exactly the same information
+func (r ServiceRecord) Equal(other ServiceRecord) bool {
+	return reflect.DeepEqual(r, other)
+}
+
+func encodeRecord(r ServiceRecord, codec Codec) ([]byte, error) {
+	codec = orJSON(codec)
+	payload, err := codec.EncodeRecord(r)
+	if err != nil {
+		return nil, err
+	}
+	return withHeader(codec.ID(), payload), nil
+}
+
+// decodeRecord decodes a SURVEY response. Responses without header come from
+// clients that only advertise a plain string, that string is used as ID and
+// Address of the record.
+func decodeRecord(msg []byte) (ServiceRecord, error) {
+	if !hasHeader(msg) {
+		return ServiceRecord{ID: string(msg), Address: string(msg)}, nil
+	}
+	codec, err := frameCodec(msg)
+	if err != nil {
+		return ServiceRecord{}, err
+	}
+	return codec.DecodeRecord(msg[headerLen:])
+}
+
+// encodeLeave encodes the SURVEY response of a client that leaves the cluster
+func encodeLeave(r ServiceRecord, codec Codec) ([]byte, error) {
+	frame, err := encodeRecord(r, codec)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{leaveVersion}, frame...), nil
+}
+
+// decodeResponse decodes a SURVEY response, leaving is true if the node leaves
+// the cluster
+func decodeResponse(msg []byte) (r ServiceRecord, leaving bool, err error) {
+	if len(msg) > 0 && msg[0] == leaveVersion {
+		r, err = decodeRecord(msg[1:])
+		return r, true, err
+	}
+	r, err = decodeRecord(msg)
+	return r, false, err
+}
+
+func encodeUpdate(u Update, codec Codec) ([]byte, error) {
+	codec = orJSON(codec)
+	payload, err := codec.EncodeUpdate(u)
+	if err != nil {
+		return nil, err
+	}
+	return withHeader(codec.ID(), payload), nil
+}
+
+func decodeUpdate(msg []byte) (Update, error) {
+	codec, err := frameCodec(msg)
+	if err != nil {
+		return Update{}, err
+	}
+	return codec.DecodeUpdate(msg[headerLen:])
+}
+
+// serviceTopic is the topic of the publications of a single service
+func serviceTopic(service string) string {
+	return servicePrefix + service
+}
+
+// subscription is the prefix that matches exactly the topic
+func subscription(topic string) []byte {
+	return append([]byte(topic), topicEnd)
+}
+
+// encodePublication prefixes the update with the topic, the update is signed
+// if there is a key
+func encodePublication(topic string, u Update, codec Codec, key ed25519.PrivateKey) ([]byte, error) {
+	msg, err := encodeUpdate(u, codec)
+	if err != nil {
+		return nil, err
+	}
+	prefix := subscription(topic)
+	msg = signMessage(key, prefix, msg)
+
+	publication := make([]byte, 0, len(prefix)+len(msg))
+	publication = append(publication, prefix...)
+	return append(publication, msg...), nil
+}
+
+// decodePublication returns the topic and the update, the signature of the
+// update is verified if there is a key
+func decodePublication(publication []byte, key ed25519.PublicKey) (string, Update, error) {
+	i := bytes.IndexByte(publication, topicEnd)
+	if i < 0 {
+		return "", Update{}, ErrMissingTopic
+	}
+	msg, err := verifyMessage(key, publication[:i+1], publication[i+1:])
+	if err != nil {
+		return "", Update{}, err
+	}
+	u, err := decodeUpdate(msg)
+	return string(publication[:i]), u, err
+}
+
+// decodeLegacyMembership decodes the membership of the old publishers, every
+// address is used as ID and Address of the record. An empty message is an
+// empty membership.
+func decodeLegacyMembership(msg []byte) []ServiceRecord {
+	nodes := make(map[string]ServiceRecord)
+	if len(msg) > 0 {
+		for _, address := range strings.Split(string(msg), legacySeparator) {
+			nodes[address] = ServiceRecord{ID: address, Address: address}
+		}
+	}
+	return sortRecords(nodes)
+}
+
+// topicService returns the service of the topic, false if the topic is not a
+// service topic
+func topicService(topic string) (string, bool) {
+	if !strings.HasPrefix(topic, servicePrefix) {
+		return "", false
+	}
+	return topic[len(servicePrefix):], true
+}
+
+// encodeFrame encodes the internal messages of the servers, always in JSON
+func encodeFrame(v interface{}) ([]byte, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return withHeader(formatJSON, payload), nil
+}
+
+func decodeFrame(msg []byte, v interface{}) error {
+	if len(msg) < headerLen || msg[0] != wireVersion {
+		return ErrUnknownWireVersion
+	}
+	if msg[1] != formatJSON {
+		return ErrUnknownFormat
+	}
+	return json.Unmarshal(msg[headerLen:], v)
+}
+
+// frameCodec returns the codec of the message
+func frameCodec(msg []byte) (Codec, error) {
+	if len(msg) < headerLen || msg[0] != wireVersion {
+		return nil, ErrUnknownWireVersion
+	}
+	return codecByID(msg[1])
+}
+
+func withHeader(format byte, payload []byte) []byte {
+	msg := make([]byte, 0, headerLen+len(payload))
+	msg = append(msg, wireVersion, format)
+	return append(msg, payload...)
+}
+
+func hasHeader(msg []byte) bool {
+	return len(msg) >= headerLen && msg[0] == wireVersion
+}
+
+// sortRecords returns the records of the map ordered by ID
+func sortRecords(nodes map[string]ServiceRecord) []ServiceRecord {
+	records := make([]ServiceRecord, 0, len(nodes))
+	for _, r := range nodes {
+		records = append(records, r)
+	}
+	sort.Sort(byID(records))
+	return records
+}
+
+// indexRecords returns the records indexed by ID
+func indexRecords(records []ServiceRecord) map[string]ServiceRecord {
+	nodes := make(map[string]ServiceRecord, len(records))
+	for _, r := range records {
+		nodes[r.ID] = r
+	}
+	return nodes
+}
+
+type byID []ServiceRecord
+
+func (s byID) Len() int           { return len(s) }
+func (s byID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+func (s byID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,124 @@
+package gopherdiscovery
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRecordEncoding(t *testing.T) {
+	Convey("A record survives the wire encoding", t, func() {
+		record := ServiceRecord{
+			ID:       "api-1",
+			Address:  "http://10.0.0.2:8080",
+			Service:  "api",
+			Version:  "2",
+			Tags:     []string{"a", "b"},
+			Metadata: map[string]string{"zone": "b"},
+		}
+		msg, err := encodeRecord(record, nil)
+		So(err, ShouldBeNil)
+
+		decoded, err := decodeRecord(msg)
+		So(err, ShouldBeNil)
+		So(decoded, ShouldResemble, record)
+	})
+
+	Convey("A plain string is decoded as ID and Address", t, func() {
+		decoded, err := decodeRecord([]byte("http://10.0.0.3:8080"))
+		So(err, ShouldBeNil)
+		So(decoded, ShouldResemble, ServiceRecord{ID: "http://10.0.0.3:8080", Address: "http://10.0.0.3:8080"})
+	})
+
+	Convey("Unknown formats are rejected", t, func() {
+		_, err := decodeRecord([]byte{wireVersion, 42, '{', '}'})
+		So(err, ShouldEqual, ErrUnknownFormat)
+	})
+}
+
+func TestUpdateEncoding(t *testing.T) {
+	Convey("The update survives the wire encoding", t, func() {
+		a := ServiceRecord{ID: "a", Address: "a"}
+		b := ServiceRecord{ID: "b", Address: "b"}
+		update := Update{
+			Revision: 3,
+			Records:  []ServiceRecord{a, b},
+			Events:   []Event{{Type: Added, Record: b, Revision: 3}},
+		}
+		msg, err := encodeUpdate(update, nil)
+		So(err, ShouldBeNil)
+
+		decoded, err := decodeUpdate(msg)
+		So(err, ShouldBeNil)
+		So(decoded, ShouldResemble, update)
+	})
+}
+
+func TestPublicationEncoding(t *testing.T) {
+	Convey("The publication keeps the topic", t, func() {
+		update := Update{Origin: "o", Revision: 1, Records: []ServiceRecord{{ID: "a", Address: "a", Service: "cache"}}}
+		msg, err := encodePublication(serviceTopic("cache"), update, nil, nil)
+		So(err, ShouldBeNil)
+		So(string(msg), ShouldStartWith, string(subscription(serviceTopic("cache"))))
+
+		topic, decoded, err := decodePublication(msg, nil)
+		So(err, ShouldBeNil)
+		So(decoded, ShouldResemble, update)
+
+		service, ok := topicService(topic)
+		So(ok, ShouldBeTrue)
+		So(service, ShouldEqual, "cache")
+
+		_, ok = topicService(allTopic)
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("A publication without topic is rejected", t, func() {
+		_, _, err := decodePublication([]byte("no topic"), nil)
+		So(err, ShouldEqual, ErrMissingTopic)
+	})
+}
+
+func TestSeparatorInIDs(t *testing.T) {
+	Convey("IDs with '|' are kept in a single record", t, func() {
+		a := ServiceRecord{ID: "urn:svc|api|1", Address: "urn:svc|api|1"}
+		update := Update{Origin: "o", Revision: 1, Records: []ServiceRecord{a}}
+
+		msg, err := encodePublication(allTopic, update, nil, nil)
+		So(err, ShouldBeNil)
+		_, decoded, err := decodePublication(msg, nil)
+		So(err, ShouldBeNil)
+		So(decoded.Records, ShouldResemble, []ServiceRecord{a})
+
+		msg, err = encodeUpdate(Update{Origin: "o", Revision: 2}, nil)
+		So(err, ShouldBeNil)
+		decoded, err = decodeUpdate(msg)
+		So(err, ShouldBeNil)
+		So(decoded.Records, ShouldBeEmpty)
+	})
+
+	Convey("The legacy membership is split on '|'", t, func() {
+		So(ids(decodeLegacyMembership([]byte("b|a|b"))), ShouldResemble, []string{"a", "b"})
+		So(decodeLegacyMembership([]byte("")), ShouldBeEmpty)
+	})
+}
+
+func TestLeaveEncoding(t *testing.T) {
+	Convey("A leave is told apart from a regular response", t, func() {
+		record := ServiceRecord{ID: "a", Address: "a"}
+
+		msg, err := encodeLeave(record, nil)
+		So(err, ShouldBeNil)
+		decoded, leaving, err := decodeResponse(msg)
+		So(err, ShouldBeNil)
+		So(leaving, ShouldBeTrue)
+		So(decoded, ShouldResemble, record)
+
+		msg, err = encodeRecord(record, nil)
+		So(err, ShouldBeNil)
+		decoded, leaving, err = decodeResponse(msg)
+		So(err, ShouldBeNil)
+		So(leaving, ShouldBeFalse)
+		So(decoded, ShouldResemble, record)
+	})
+}
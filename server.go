@@ -1,17 +1,19 @@
 package gopherdiscovery
 
 import (
-	"log"
-	"strings"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"golang.org/x/net/context"
-
 	"github.com/gdamore/mangos"
 	"github.com/gdamore/mangos/protocol/pub"
 	"github.com/gdamore/mangos/protocol/surveyor"
-	"github.com/gdamore/mangos/transport/ipc"
-	"github.com/gdamore/mangos/transport/tcp"
 )
 
 type Options struct {
@@ -23,6 +25,91 @@ type Options struct {
 	// PollTime is minimal time between SURVEYS (The time between SURVEYS could be greater than this time
 	// if the SURVEY process takes longer than that time)
 	PollTime time.Duration
+	// MaxMissedSurveys is the number of consecutive SURVEYS a node can miss
+	// before it is removed from the membership, 0 removes it on the first miss
+	MaxMissedSurveys int
+	// TTL is the time a node stays in the membership since its last
+	// response, it is used instead of MaxMissedSurveys if it is not 0
+	TTL time.Duration
+
+	// Store keeps the membership across restarts of the server. Disabled if nil
+	Store StateStore
+	// WarmUp is the time after a restart when the nodes loaded from the Store
+	// are not removed even if they miss SURVEYS, so the subscribers do not see
+	// them vanish while the clients find the server again
+	WarmUp time.Duration
+
+	// RepublishTime is the time between publications of the full membership
+	// even if there are no changes, so late subscribers catch up. Disabled if 0
+	RepublishTime time.Duration
+
+	// ControlURL is the url of the request/reply endpoint that serves the
+	// current membership on demand, for example tcp://127.0.0.1:60007.
+	// Disabled if empty
+	ControlURL string
+
+	// ElectionURL is the url of the bus socket the servers use to elect the
+	// leader, for example tcp://127.0.0.1:45007. Only the leader publishes
+	// the membership, the rest keep surveying to take over with the
+	// membership already known. The heartbeats are signed with the SharedKey
+	// or the SigningKey, without them the bus has to be a trusted network.
+	// Disabled if empty, every server publishes
+	ElectionURL string
+	// ElectionPeers are the ElectionURL of the rest of the servers
+	ElectionPeers []string
+	// ServerID identifies the server in the election, the alive server with
+	// the highest ID is the leader once it has finished a SURVEY and the
+	// ElectionTimeout. ElectionURL if empty
+	ServerID string
+	// HeartbeatTime is the time between heartbeats to the rest of the
+	// servers, DefaultHeartbeatTime if 0
+	HeartbeatTime time.Duration
+	// ElectionTimeout is the time without heartbeats before a server is
+	// gone, 3 times the HeartbeatTime if 0
+	ElectionTimeout time.Duration
+
+	// Transport options of every socket of the server
+	Transport TransportOptions
+
+	// SharedKey authenticates the SURVEY responses, the clients sign them
+	// with the same key. Responses without a valid signature are rejected.
+	// It also signs the election heartbeats. Disabled if empty
+	SharedKey []byte
+
+	// SigningKey signs the publications and the replies of the control
+	// endpoint, the subscribers verify them with the public key. It signs the
+	// election heartbeats if there is no SharedKey. Disabled if nil
+	SigningKey ed25519.PrivateKey
+
+	// Admission decides which nodes join the membership, every node is
+	// admitted if nil
+	Admission AdmissionPolicy
+
+	// Codec of the publications, JSONCodec if nil. The control endpoint
+	// always replies in JSON
+	Codec Codec
+
+	// ExcludeUnhealthy leaves the nodes with critical health out of the
+	// membership while they keep answering, they are back once they recover
+	ExcludeUnhealthy bool
+
+	// Prober checks the address of every node every ProbeInterval, the
+	// published health is the worst of the reported and the probed one.
+	// DefaultProbeInterval and DefaultProbeConcurrency if 0. Disabled if nil
+	Prober           Prober
+	ProbeInterval    time.Duration
+	ProbeConcurrency int
+
+	// Logger of the server and its Publisher, StdLogger if nil
+	Logger Logger
+
+	// Metrics of the SURVEYS, the membership and the publications. Disabled
+	// if nil
+	Metrics Metrics
+
+	// AdminAddr is the address of the HTTP admin API, for example
+	// 127.0.0.1:8500. Disabled if empty
+	AdminAddr string
 }
 
 type DiscoveryServer struct {
@@ -35,135 +122,462 @@ type DiscoveryServer struct {
 	urlPubSub string
 
 	// Time options
-	opt Options
+	opt     Options
+	logger  Logger
+	metrics Metrics
 
 	// Set of the services that has been discovered
-	services *Services
+	services  *Services
+	publisher *Publisher
+
+	lifecycle
+	sock        mangos.Socket
+	controlSock mangos.Socket
+	// clients connected to sock
+	peers *int32
+
+	// leader election, nil if disabled
+	election *election
 
-	ctx    context.Context
-	cancel context.CancelFunc
-	sock   mangos.Socket
+	// listener of the admin API, nil if disabled
+	adminListener net.Listener
+
+	// number of SURVEY responses rejected
+	rejected uint64
+	// number of nodes denied by the AdmissionPolicy
+	denied uint64
 }
 
 type Services struct {
-	// set of nodes discovered
-	nodes StringSet
+	sync.Mutex
+
+	// origin identifies this set of services, the revision only increases
+	// within the same origin
+	origin string
+	// nodes discovered indexed by ID
+	nodes map[string]*node
+	// revision of the membership, increased on every change
+	revision uint64
+	// only active services publish the changes
+	active bool
 	// publisher, we are going to publish the changes of the set here
 	publisher *Publisher
+
+	// tolerance before removing a node
+	maxMissed int
+	ttl       time.Duration
+
+	// the membership is saved in the store on every change
+	store   StateStore
+	logger  Logger
+	metrics Metrics
+	// nodes restored from the store are not removed until then
+	warmUntil time.Time
+
+	// the nodes with critical health are not in the membership
+	excludeUnhealthy bool
+
+	// channels of the admin API that get every change
+	watchers map[chan Update]struct{}
+}
+
+// node is the state of a discovered node
+type node struct {
+	record ServiceRecord
+	// last time the node answered a SURVEY
+	lastSeen time.Time
+	// number of consecutive SURVEYS without response
+	missed int
+	// loaded from the store and not seen since the restart
+	restored bool
+	// health probed by the server, empty if it is not probed
+	probed HealthStatus
+}
+
+type PublisherOptions struct {
+	Transport TransportOptions
+
+	// SigningKey signs every publication. Disabled if nil
+	SigningKey ed25519.PrivateKey
+
+	// Codec of the publications, JSONCodec if nil
+	Codec Codec
+
+	// Logger of the Publisher, StdLogger if nil
+	Logger Logger
+
+	// Metrics of the publication errors. Disabled if nil
+	Metrics Metrics
 }
 
 type Publisher struct {
 	// url for pub/sub
 	url string
 
-	ctx  context.Context
+	signingKey ed25519.PrivateKey
+	codec      Codec
+	logger     Logger
+	metrics    Metrics
+
+	lifecycle
 	sock mangos.Socket
 
-	publishCh chan []string
+	publishCh chan publication
+}
+
+type publication struct {
+	topic  string
+	update Update
 }
 
 func Server(urlServer string, urlPubSub string, opt Options) (*DiscoveryServer, error) {
+	return newServer(context.Background(), urlServer, urlPubSub, opt)
+}
+
+func newServer(ctx context.Context, urlServer string, urlPubSub string, opt Options) (*DiscoveryServer, error) {
 	var sock mangos.Socket
 	var err error
 	var publisher *Publisher
-
-	ctx, cancel := context.WithCancel(context.Background())
+	var controlSock mangos.Socket
 
 	sock, err = surveyor.NewSocket()
 	if err != nil {
 		return nil, err
 	}
 
-	sock.AddTransport(ipc.NewTransport())
-	sock.AddTransport(tcp.NewTransport())
+	err = addTransports(sock, opt.Transport)
+	if err != nil {
+		sock.Close()
+		return nil, err
+	}
+
+	// the clients to wait for when the server is closing
+	var peers int32
+	sock.SetPortHook(func(action mangos.PortAction, _ mangos.Port) bool {
+		switch action {
+		case mangos.PortActionAdd:
+			atomic.AddInt32(&peers, 1)
+		case mangos.PortActionRemove:
+			atomic.AddInt32(&peers, -1)
+		}
+		return true
+	})
 
-	err = sock.Listen(urlServer)
+	err = listen(sock, urlServer, opt.Transport)
 	if err != nil {
+		sock.Close()
 		return nil, err
 	}
 	err = sock.SetOption(mangos.OptionSurveyTime, opt.SurveyTime)
 	if err != nil {
+		sock.Close()
 		return nil, err
 	}
 	err = sock.SetOption(mangos.OptionRecvDeadline, opt.RecvDeadline)
 	if err != nil {
+		sock.Close()
 		return nil, err
 	}
 
-	pubCtx, pubCancel := context.WithCancel(ctx)
-	publisher, err = NewPublisher(pubCtx, urlPubSub)
+	// the Publisher, the Services and the election share the limits of the
+	// Logger
+	opt.Logger = newLogger(opt.Logger)
+	server := &DiscoveryServer{
+		urlServer: urlServer,
+		urlPubSub: urlPubSub,
+		opt:       opt,
+		logger:    opt.Logger,
+		metrics:   orNoMetrics(opt.Metrics),
+
+		sock:  sock,
+		peers: &peers,
+	}
+	server.init(ctx)
+
+	// on error, stops the server and closes everything opened so far
+	defer func() {
+		if err == nil {
+			return
+		}
+		server.cancel()
+		if publisher != nil {
+			publisher.Close()
+		}
+		closeSockets(sock, controlSock)
+		if server.election != nil {
+			closeSockets(server.election.sock)
+		}
+		if server.adminListener != nil {
+			server.adminListener.Close()
+		}
+	}()
+
+	publisher, err = NewPublisherWithOptions(server.ctx, urlPubSub, PublisherOptions{
+		Transport:  opt.Transport,
+		SigningKey: opt.SigningKey,
+		Codec:      opt.Codec,
+		Logger:     server.logger,
+		Metrics:    opt.Metrics,
+	})
 	if err != nil {
-		pubCancel()
 		return nil, err
 	}
-	services := NewServices(publisher)
+	server.publisher = publisher
 
-	server := &DiscoveryServer{
-		services: services,
+	services := NewServices(publisher, opt)
+	if opt.Store != nil {
+		var state State
+		state, err = opt.Store.Load()
+		if err != nil {
+			return nil, err
+		}
+		services.Restore(state, opt.WarmUp)
+	}
+	server.services = services
 
-		urlServer: urlServer,
-		urlPubSub: urlPubSub,
-		opt:       opt,
+	if opt.ControlURL != "" {
+		controlSock, err = listenControl(opt.ControlURL, opt.Transport)
+		if err != nil {
+			return nil, err
+		}
+		server.controlSock = controlSock
+	}
+
+	if opt.ElectionURL != "" {
+		// stands by until it wins the election
+		services.SetActive(false)
+		server.election, err = newElection(server.ctx, opt, server.logger, services.SetActive)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-		ctx:    ctx,
-		cancel: cancel,
-		sock:   sock,
+	if opt.AdminAddr != "" {
+		err = server.listenAdmin()
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	go server.run()
+	// run closes the socket of the SURVEYS
+	server.closeOnDone(controlSock)
+	server.goRun(server.run)
+	if server.election != nil {
+		server.closeOnDone(server.election.sock)
+		server.goRun(server.election.run)
+	}
+	if opt.Prober != nil {
+		server.goRun(server.runProbes)
+	}
+	if controlSock != nil {
+		server.goRun(server.serveControl)
+	}
+	if server.adminListener != nil {
+		server.goRun(server.serveAdmin)
+	}
 	return server, nil
 }
 
+// Close shuts down the server, it closes the sockets and waits for the
+// goroutines of the server and its Publisher
+func (d *DiscoveryServer) Close() error {
+	err := d.close()
+	pubErr := d.publisher.Close()
+	if err != nil {
+		return err
+	}
+	return pubErr
+}
+
 // Shutdown the server
 func (d *DiscoveryServer) Cancel() {
-	d.cancel()
+	d.Close()
 }
 
-// Waits until the server finish running
+// IsLeader reports if the server publishes the membership, always true if
+// there is no election
+func (d *DiscoveryServer) IsLeader() bool {
+	if d.election == nil {
+		return true
+	}
+	return d.election.Leader() == d.election.id
+}
+
+// Leader returns the ServerID of the current leader, empty if there is no
+// election or no leader yet
+func (d *DiscoveryServer) Leader() string {
+	if d.election == nil {
+		return ""
+	}
+	return d.election.Leader()
+}
+
+// Waits until the server finish running, it is done once it is closed or
+// the context of NewServer is done
 func (d *DiscoveryServer) Wait() {
 	<-d.ctx.Done()
 }
 
 func (d *DiscoveryServer) run() {
+	var republish <-chan time.Time
+
+	if d.opt.RepublishTime > 0 {
+		ticker := time.NewTicker(d.opt.RepublishTime)
+		defer ticker.Stop()
+		republish = ticker.C
+	}
+
+	poll := time.After(d.opt.PollTime)
 	for {
 		select {
-		case <-time.After(d.opt.PollTime):
+		case <-poll:
 			d.poll()
+			poll = time.After(d.opt.PollTime)
+		case <-republish:
+			d.services.Republish()
 		case <-d.ctx.Done():
+			d.closeSurvey()
 			return
 		}
 	}
 }
 
+// closingSurvey tells the clients the server is closing, so they do not wait
+// for its next SURVEY to leave the cluster. It is not a nonce, those have
+// nonceLen bytes
+var closingSurvey = []byte("gopherdiscovery: closing")
+
+// closeSurvey sends the closingSurvey and closes the socket. It waits for
+// every client to acknowledge it, at most the SurveyTime, as closing the
+// socket drops the SURVEYS not sent yet
+func (d *DiscoveryServer) closeSurvey() {
+	err := d.sock.Send(closingSurvey)
+	for acks := int32(0); err == nil && acks < atomic.LoadInt32(d.peers); acks++ {
+		_, err = d.sock.Recv()
+	}
+	d.closeNow(d.sock)
+}
+
 func (d *DiscoveryServer) poll() {
 	var err error
 	var msg []byte
-	var responses StringSet
+	var nonce []byte
+	var record ServiceRecord
+	var leaving bool
+	var responses map[string]ServiceRecord
+	var members StringSet
 
-	err = d.sock.Send([]byte(""))
+	nonce, err = newNonce()
+	if err != nil {
+		d.logger.Error("DiscoveryServer: Error creating the SURVEY nonce", "error", err)
+		return
+	}
+	err = d.sock.Send(nonce)
 	if err != nil {
-		log.Println("DiscoveryServer: Error sending the SURVEY", err.Error())
+		d.logger.Error("DiscoveryServer: Error sending the SURVEY", "url", d.urlServer, "error", err)
 		return
 	}
 
-	responses = NewStringSet()
+	start := time.Now()
+	d.metrics.Add(MetricSurveyRounds, 1)
+
+	responses = make(map[string]ServiceRecord)
+	members = d.services.memberIDs()
 	for {
 		msg, err = d.sock.Recv()
 		if err != nil {
 			if err == mangos.ErrRecvTimeout {
 				// Timeout means I can add the current responses to the SET
+				d.metrics.Set(MetricSurveyResponses, float64(len(responses)))
 				d.services.Add(responses)
+				if d.election != nil {
+					d.election.setPolled()
+				}
+				return
+			}
+			if d.ctx.Err() != nil {
+				// the socket is closed
 				return
 			}
-			log.Println("DiscoveryServer: Error reading SURVEY responses", err.Error())
+			// the responses of this SURVEY are lost, the next one comes
+			// after the PollTime
+			d.logger.Error("DiscoveryServer: Error reading SURVEY responses", "url", d.urlServer, "error", err)
+			return
 		} else {
-			responses.Add(string(msg))
+			d.metrics.Observe(MetricSurveyLatency, time.Since(start).Seconds())
+			msg, err = d.authenticate(nonce, msg)
+			if err != nil {
+				atomic.AddUint64(&d.rejected, 1)
+				d.logger.Warn("DiscoveryServer: Rejected SURVEY response", "url", d.urlServer, "error", err)
+				continue
+			}
+			record, leaving, err = decodeResponse(msg)
+			if err != nil {
+				d.logger.Warn("DiscoveryServer: Error decoding SURVEY response", "url", d.urlServer, "error", err)
+				continue
+			}
+			if leaving {
+				delete(responses, record.ID)
+				d.services.Leave(record.ID)
+				continue
+			}
+			if !d.admit(record, members) {
+				continue
+			}
+			responses[record.ID] = record
 		}
 	}
 
 }
 
+// authenticate verifies the signature of the SURVEY response if the server
+// has a SharedKey, and returns the response without signature
+func (d *DiscoveryServer) authenticate(nonce []byte, msg []byte) ([]byte, error) {
+	if len(d.opt.SharedKey) > 0 {
+		return verifyResponse(d.opt.SharedKey, nonce, msg)
+	}
+	if _, frame, err := decodeSigned(msg); err == nil {
+		return frame, nil
+	}
+	return msg, nil
+}
+
+// admit asks the AdmissionPolicy if the node can join the membership, members
+// are the IDs of the nodes in the membership and the ones admitted so far
+func (d *DiscoveryServer) admit(record ServiceRecord, members StringSet) bool {
+	if d.opt.Admission == nil {
+		return true
+	}
+	others := len(members)
+	if members.Contains(record.ID) {
+		others--
+	}
+	err := d.opt.Admission.Admit(record, others)
+	if err != nil {
+		atomic.AddUint64(&d.denied, 1)
+		d.logger.Warn("DiscoveryServer: Denied admission", "id", record.ID, "service", record.Service, "error", err)
+		return false
+	}
+	members.Add(record.ID)
+	return true
+}
+
+// Denied returns the number of SURVEY responses denied by the AdmissionPolicy
+func (d *DiscoveryServer) Denied() uint64 {
+	return atomic.LoadUint64(&d.denied)
+}
+
+// Rejected returns the number of SURVEY responses rejected because they were
+// not signed or the signature was not valid
+func (d *DiscoveryServer) Rejected() uint64 {
+	return atomic.LoadUint64(&d.rejected)
+}
+
 func NewPublisher(ctx context.Context, url string) (*Publisher, error) {
+	return NewPublisherWithOptions(ctx, url, PublisherOptions{})
+}
+
+func NewPublisherWithOptions(ctx context.Context, url string, opt PublisherOptions) (*Publisher, error) {
 	var sock mangos.Socket
 	var err error
 
@@ -171,64 +585,412 @@ func NewPublisher(ctx context.Context, url string) (*Publisher, error) {
 	if err != nil {
 		return nil, err
 	}
-	sock.AddTransport(ipc.NewTransport())
-	sock.AddTransport(tcp.NewTransport())
+	err = addTransports(sock, opt.Transport)
+	if err != nil {
+		sock.Close()
+		return nil, err
+	}
 
-	err = sock.Listen(url)
+	err = listen(sock, url, opt.Transport)
 	if err != nil {
+		sock.Close()
 		return nil, err
 	}
 
 	publiser := &Publisher{
-		ctx:  ctx,
-		url:  url,
-		sock: sock,
+		url: url,
 
-		publishCh: make(chan []string),
+		signingKey: opt.SigningKey,
+		codec:      opt.Codec,
+		logger:     newLogger(opt.Logger),
+		metrics:    orNoMetrics(opt.Metrics),
+		sock:       sock,
+
+		publishCh: make(chan publication),
 	}
+	publiser.init(ctx)
 
-	go publiser.run()
+	publiser.closeOnDone(sock)
+	publiser.goRun(publiser.run)
 	return publiser, nil
 }
 
-func (p *Publisher) Publish(msg []string) {
-	p.publishCh <- msg
+// Close stops publishing, it closes the socket and waits for the goroutines
+func (p *Publisher) Close() error {
+	return p.close()
+}
+
+// Publish the update of the whole membership
+func (p *Publisher) Publish(update Update) {
+	p.publish(publication{topic: allTopic, update: update})
+}
+
+// PublishService publishes the update of a single service, only the
+// subscribers of that service get it
+func (p *Publisher) PublishService(service string, update Update) {
+	p.publish(publication{topic: serviceTopic(service), update: update})
+}
+
+// publish drops the publication once the Publisher is cancelled
+func (p *Publisher) publish(publication publication) {
+	select {
+	case <-p.ctx.Done():
+	case p.publishCh <- publication:
+	}
 }
 
 func (p *Publisher) run() {
 	for {
 		select {
 		case <-p.ctx.Done():
-			close(p.publishCh)
 			return
-		case msg := <-p.publishCh:
-			err := p.sock.Send([]byte(strings.Join(msg, "|")))
+		case publication := <-p.publishCh:
+			msg, err := encodePublication(publication.topic, publication.update, p.codec, p.signingKey)
+			if err != nil {
+				p.metrics.Add(MetricPublishErrors, 1)
+				p.logger.Error("DiscoveryServer: Error encoding changes", "topic", publication.topic, "error", err)
+				continue
+			}
+			err = p.sock.Send(msg)
 			if err != nil {
-				log.Println("DiscoveryServer: Error PUBLISHING changes to the socket", err.Error())
+				p.metrics.Add(MetricPublishErrors, 1)
+				p.logger.Error("DiscoveryServer: Error PUBLISHING changes to the socket", "url", p.url, "error", err)
 			}
 		}
 	}
 }
 
-func NewServices(publisher *Publisher) *Services {
+func NewServices(publisher *Publisher, opt Options) *Services {
 	s := &Services{
-		nodes:     NewStringSet(),
+		origin:    newOrigin(),
+		nodes:     make(map[string]*node),
 		publisher: publisher,
+		active:    true,
+		maxMissed: opt.MaxMissedSurveys,
+		ttl:       opt.TTL,
+		store:     opt.Store,
+		logger:    newLogger(opt.Logger),
+		metrics:   orNoMetrics(opt.Metrics),
+
+		excludeUnhealthy: opt.ExcludeUnhealthy,
+		watchers:         make(map[chan Update]struct{}),
 	}
 
 	return s
 }
 
-func (s *Services) Add(responses StringSet) {
-	removed := s.nodes.Difference(responses)
-	added := responses.Difference(s.nodes)
+// Add updates the membership with the responses of a SURVEY, the nodes that
+// did not answer are removed once they run out of tolerance
+func (s *Services) Add(responses map[string]ServiceRecord) {
+	s.Lock()
+	defer s.Unlock()
 
-	// Do not publish anything if there is no changes
-	if removed.Cardinality() == 0 && added.Cardinality() == 0 {
+	now := time.Now()
+	previous := s.records()
+
+	for id, record := range responses {
+		n, ok := s.nodes[id]
+		if !ok {
+			n = &node{}
+			s.nodes[id] = n
+		}
+		n.record = record
+		n.lastSeen = now
+		n.missed = 0
+		n.restored = false
+	}
+	for id, n := range s.nodes {
+		if _, ok := responses[id]; ok {
+			continue
+		}
+		n.missed++
+		if n.restored && now.Before(s.warmUntil) {
+			continue
+		}
+		if s.expired(n, now) {
+			delete(s.nodes, id)
+		}
+	}
+
+	s.changed(previous)
+}
+
+// Leave removes the node right away, it left the cluster gracefully
+func (s *Services) Leave(id string) {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.nodes[id]; !ok {
 		return
 	}
+	previous := s.records()
+	delete(s.nodes, id)
+	s.changed(previous)
+}
+
+// SetProbed updates the health of the nodes probed by the server, the nodes
+// that are not in the membership anymore are ignored
+func (s *Services) SetProbed(probed map[string]HealthStatus) {
+	s.Lock()
+	defer s.Unlock()
+
+	previous := s.records()
+	for id, health := range probed {
+		if n, ok := s.nodes[id]; ok {
+			n.probed = health
+		}
+	}
+	s.changed(previous)
+}
+
+// changed publishes the changes from the previous membership, if any
+func (s *Services) changed(previous map[string]ServiceRecord) {
+	current := s.records()
+	events := diff(previous, current, s.revision+1)
 
-	s.nodes = responses
+	// Do not publish anything if there is no changes
+	if len(events) == 0 {
+		return
+	}
+	s.measure(events, len(current))
+
+	s.revision++
+	s.save()
+	update := Update{
+		Origin:   s.origin,
+		Revision: s.revision,
+		Records:  sortRecords(current),
+		Events:   events,
+	}
+	s.notify(update)
+	if !s.active {
+		return
+	}
 	// publish the changes
-	s.publisher.Publish(s.nodes.ToSlice())
+	s.publisher.Publish(update)
+
+	// and the changes of every service on its own topic
+	before := byService(previous)
+	after := byService(current)
+	for _, service := range serviceNames(before, after) {
+		events = diff(before[service], after[service], s.revision)
+		if len(events) == 0 {
+			continue
+		}
+		s.publisher.PublishService(service, Update{
+			Origin:   s.origin,
+			Revision: s.revision,
+			Records:  sortRecords(after[service]),
+			Events:   events,
+		})
+	}
+}
+
+// measure counts the nodes added and removed, and the size of the membership
+func (s *Services) measure(events []Event, members int) {
+	for _, event := range events {
+		switch event.Type {
+		case Added:
+			s.metrics.Add(MetricNodesAdded, 1)
+		case Removed:
+			s.metrics.Add(MetricNodesRemoved, 1)
+		}
+	}
+	s.metrics.Set(MetricMembers, float64(members))
+}
+
+// Snapshot returns the current membership without events, only the nodes of
+// the given services if there is any
+func (s *Services) Snapshot(services ...string) Update {
+	s.Lock()
+	defer s.Unlock()
+
+	nodes := s.records()
+	if len(services) > 0 {
+		nodes = make(map[string]ServiceRecord)
+		wanted := NewStringSet()
+		for _, service := range services {
+			wanted.Add(service)
+		}
+		for id, record := range s.records() {
+			if wanted.Contains(record.Service) {
+				nodes[id] = record
+			}
+		}
+	}
+
+	return Update{
+		Origin:   s.origin,
+		Revision: s.revision,
+		Records:  sortRecords(nodes),
+	}
+}
+
+// Republish publishes the current membership again, and the membership of
+// every service on its own topic
+func (s *Services) Republish() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.republish()
+}
+
+// Restore loads the membership saved in a StateStore, the restored nodes are
+// not removed during the warm up
+func (s *Services) Restore(state State, warmUp time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+
+	if state.Origin != "" {
+		s.origin = state.Origin
+		s.revision = state.Revision
+	}
+	for _, ns := range state.Nodes {
+		s.nodes[ns.Record.ID] = &node{
+			record:   ns.Record,
+			lastSeen: ns.LastSeen,
+			restored: true,
+		}
+	}
+	s.warmUntil = time.Now().Add(warmUp)
+}
+
+// save writes the membership in the store, if there is one
+func (s *Services) save() {
+	if s.store == nil {
+		return
+	}
+
+	state := State{Origin: s.origin, Revision: s.revision}
+	for _, record := range sortRecords(s.records()) {
+		state.Nodes = append(state.Nodes, NodeState{Record: record, LastSeen: s.nodes[record.ID].lastSeen})
+	}
+	err := s.store.Save(state)
+	if err != nil {
+		s.logger.Error("DiscoveryServer: Error saving the membership", "error", err)
+	}
+}
+
+// SetActive starts or stops publishing the changes, the current membership is
+// published when the services become active
+func (s *Services) SetActive(active bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	if active && !s.active {
+		s.active = true
+		s.republish()
+	}
+	s.active = active
+}
+
+func (s *Services) republish() {
+	if !s.active {
+		return
+	}
+
+	current := s.records()
+	s.publisher.Publish(Update{
+		Origin:   s.origin,
+		Revision: s.revision,
+		Records:  sortRecords(current),
+	})
+
+	services := byService(current)
+	for _, service := range serviceNames(services) {
+		s.publisher.PublishService(service, Update{
+			Origin:   s.origin,
+			Revision: s.revision,
+			Records:  sortRecords(services[service]),
+		})
+	}
+}
+
+// expired reports if the node has missed too many SURVEYS
+func (s *Services) expired(n *node, now time.Time) bool {
+	if s.ttl > 0 {
+		return now.Sub(n.lastSeen) > s.ttl
+	}
+	return n.missed > s.maxMissed
+}
+
+// memberIDs returns the IDs of the nodes in the membership
+func (s *Services) memberIDs() StringSet {
+	s.Lock()
+	defer s.Unlock()
+
+	ids := NewStringSet()
+	for id := range s.nodes {
+		ids.Add(id)
+	}
+	return ids
+}
+
+// records returns the membership indexed by ID
+func (s *Services) records() map[string]ServiceRecord {
+	records := make(map[string]ServiceRecord, len(s.nodes))
+	for id, n := range s.nodes {
+		record := n.record
+		record.Health = worstHealth(record.Health, n.probed)
+		if s.excludeUnhealthy && record.Health == HealthCritical {
+			continue
+		}
+		records[id] = record
+	}
+	return records
+}
+
+// probeTargets returns the records of every node to probe, also the ones
+// left out of the membership because of their health
+func (s *Services) probeTargets() []ServiceRecord {
+	s.Lock()
+	defer s.Unlock()
+
+	records := make([]ServiceRecord, 0, len(s.nodes))
+	for _, n := range s.nodes {
+		records = append(records, n.record)
+	}
+	return records
+}
+
+// byService groups the nodes by the name of the service
+func byService(nodes map[string]ServiceRecord) map[string]map[string]ServiceRecord {
+	services := make(map[string]map[string]ServiceRecord)
+	for id, record := range nodes {
+		if services[record.Service] == nil {
+			services[record.Service] = make(map[string]ServiceRecord)
+		}
+		services[record.Service][id] = record
+	}
+	return services
+}
+
+// serviceNames returns the sorted names of the services in any of the groups
+func serviceNames(groups ...map[string]map[string]ServiceRecord) []string {
+	names := NewStringSet()
+	for _, group := range groups {
+		for service := range group {
+			names.Add(service)
+		}
+	}
+	s := names.ToSlice()
+	sort.Strings(s)
+	return s
+}
+
+func newOrigin() string {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return time.Now().Format(time.RFC3339Nano)
+	}
+	return hex.EncodeToString(b)
+}
+
+func recordIDs(nodes map[string]ServiceRecord) StringSet {
+	ids := NewStringSet()
+	for id := range nodes {
+		ids.Add(id)
+	}
+	return ids
 }
@@ -1,11 +1,16 @@
 package gopherdiscovery
 
 import (
+	"context"
+	"crypto/ed25519"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sync/atomic"
 	"testing"
 	"time"
 
-	"golang.org/x/net/context"
-
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -17,10 +22,29 @@ var (
 	}
 )
 
+func ids(records []ServiceRecord) []string {
+	var s []string
+	for _, r := range records {
+		s = append(s, r.ID)
+	}
+	return s
+}
+
+// changesWithin returns the next membership, false if it does not arrive
+// before the timeout
+func changesWithin(changes chan []ServiceRecord, timeout time.Duration) ([]ServiceRecord, bool) {
+	select {
+	case records := <-changes:
+		return records, true
+	case <-time.After(timeout):
+		return nil, false
+	}
+}
+
 func TestServerCancel(t *testing.T) {
 	Convey("Discovery server can be canceled", t, func() {
-		urlServ := "tcp://127.0.0.1:40001"
-		urlPubSub := "tcp://127.0.0.1:50001"
+		urlServ := "inproc://survey/01"
+		urlPubSub := "inproc://pubsub/01"
 
 		server, err := Server(urlServ, urlPubSub, defaultOpts)
 		So(err, ShouldBeNil)
@@ -33,8 +57,8 @@ func TestServerCancel(t *testing.T) {
 func TestClientCancel(t *testing.T) {
 	Convey("Discovery server and client can be canceled", t, func() {
 
-		urlServ := "tcp://127.0.0.1:40002"
-		urlPubSub := "tcp://127.0.0.1:50002"
+		urlServ := "inproc://survey/02"
+		urlPubSub := "inproc://pubsub/02"
 
 		server, err := Server(urlServ, urlPubSub, defaultOpts)
 		So(err, ShouldBeNil)
@@ -51,8 +75,8 @@ func TestClientCancel(t *testing.T) {
 func TestServerDiscovery(t *testing.T) {
 	Convey("Discover one client", t, func() {
 
-		urlServ := "tcp://127.0.0.1:40003"
-		urlPubSub := "tcp://127.0.0.1:50003"
+		urlServ := "inproc://survey/03"
+		urlPubSub := "inproc://pubsub/03"
 
 		server, err := Server(urlServ, urlPubSub, defaultOpts)
 		So(err, ShouldBeNil)
@@ -64,7 +88,7 @@ func TestServerDiscovery(t *testing.T) {
 		So(err, ShouldBeNil)
 		clients := <-peers
 
-		So(clients, ShouldResemble, []string{"client1"})
+		So(clients, ShouldResemble, []ServiceRecord{{ID: "client1", Address: "client1"}})
 
 		server.Cancel()
 		client.Cancel()
@@ -74,8 +98,8 @@ func TestServerDiscovery(t *testing.T) {
 
 func TestServerDiscoveryMultipleClients(t *testing.T) {
 	Convey("Discover multiple clients", t, func() {
-		urlServ := "tcp://127.0.0.1:40004"
-		urlPubSub := "tcp://127.0.0.1:50004"
+		urlServ := "inproc://survey/04"
+		urlPubSub := "inproc://pubsub/04"
 
 		server, err := Server(urlServ, urlPubSub, defaultOpts)
 		So(err, ShouldBeNil)
@@ -96,25 +120,25 @@ func TestServerDiscoveryMultipleClients(t *testing.T) {
 		So(err, ShouldBeNil)
 		clients := <-peers
 
-		So(clients, ShouldContain, "client1")
-		So(clients, ShouldContain, "client2")
-		So(clients, ShouldContain, "client3")
+		So(ids(clients), ShouldContain, "client1")
+		So(ids(clients), ShouldContain, "client2")
+		So(ids(clients), ShouldContain, "client3")
 
 		peers, err = clientTwo.Peers()
 		So(err, ShouldBeNil)
 		clients = <-peers
 
-		So(clients, ShouldContain, "client1")
-		So(clients, ShouldContain, "client2")
-		So(clients, ShouldContain, "client3")
+		So(ids(clients), ShouldContain, "client1")
+		So(ids(clients), ShouldContain, "client2")
+		So(ids(clients), ShouldContain, "client3")
 
 		peers, err = clientThree.Peers()
 		So(err, ShouldBeNil)
 		clients = <-peers
 
-		So(clients, ShouldContain, "client1")
-		So(clients, ShouldContain, "client2")
-		So(clients, ShouldContain, "client3")
+		So(ids(clients), ShouldContain, "client1")
+		So(ids(clients), ShouldContain, "client2")
+		So(ids(clients), ShouldContain, "client3")
 
 		server.Cancel()
 		clientOne.Cancel()
@@ -126,8 +150,8 @@ func TestServerDiscoveryMultipleClients(t *testing.T) {
 
 func TestServerDiscoveryAddClients(t *testing.T) {
 	Convey("Discover when you add more clients", t, func() {
-		urlServ := "tcp://127.0.0.1:40005"
-		urlPubSub := "tcp://127.0.0.1:50005"
+		urlServ := "inproc://survey/05"
+		urlPubSub := "inproc://pubsub/05"
 
 		server, err := Server(urlServ, urlPubSub, defaultOpts)
 		So(err, ShouldBeNil)
@@ -140,7 +164,7 @@ func TestServerDiscoveryAddClients(t *testing.T) {
 		So(err, ShouldBeNil)
 		clients := <-peers
 
-		So(clients, ShouldContain, "client1")
+		So(ids(clients), ShouldContain, "client1")
 
 		// client2
 		clientTwo, err := ClientWithSub(urlServ, urlPubSub, "client2")
@@ -148,8 +172,8 @@ func TestServerDiscoveryAddClients(t *testing.T) {
 
 		clients = <-peers
 
-		So(clients, ShouldContain, "client1")
-		So(clients, ShouldContain, "client2")
+		So(ids(clients), ShouldContain, "client1")
+		So(ids(clients), ShouldContain, "client2")
 
 		// client3
 		clientThree, err := ClientWithSub(urlServ, urlPubSub, "client3")
@@ -157,9 +181,9 @@ func TestServerDiscoveryAddClients(t *testing.T) {
 
 		clients = <-peers
 
-		So(clients, ShouldContain, "client1")
-		So(clients, ShouldContain, "client2")
-		So(clients, ShouldContain, "client3")
+		So(ids(clients), ShouldContain, "client1")
+		So(ids(clients), ShouldContain, "client2")
+		So(ids(clients), ShouldContain, "client3")
 
 		server.Cancel()
 		clientOne.Cancel()
@@ -171,8 +195,8 @@ func TestServerDiscoveryAddClients(t *testing.T) {
 
 func TestServerDiscoveryRemoveClients(t *testing.T) {
 	Convey("Discover when you remove clients", t, func() {
-		urlServ := "tcp://127.0.0.1:40006"
-		urlPubSub := "tcp://127.0.0.1:50006"
+		urlServ := "inproc://survey/06"
+		urlPubSub := "inproc://pubsub/06"
 
 		server, err := Server(urlServ, urlPubSub, defaultOpts)
 		So(err, ShouldBeNil)
@@ -193,22 +217,22 @@ func TestServerDiscoveryRemoveClients(t *testing.T) {
 		So(err, ShouldBeNil)
 		clients := <-peers
 
-		So(clients, ShouldContain, "client1")
-		So(clients, ShouldContain, "client2")
-		So(clients, ShouldContain, "client3")
+		So(ids(clients), ShouldContain, "client1")
+		So(ids(clients), ShouldContain, "client2")
+		So(ids(clients), ShouldContain, "client3")
 
 		clientThree.Cancel()
 
 		clients = <-peers
 
-		So(clients, ShouldContain, "client1")
-		So(clients, ShouldContain, "client2")
+		So(ids(clients), ShouldContain, "client1")
+		So(ids(clients), ShouldContain, "client2")
 
 		clientTwo.Cancel()
 
 		clients = <-peers
 
-		So(clients, ShouldContain, "client1")
+		So(ids(clients), ShouldContain, "client1")
 
 		server.Cancel()
 		clientOne.Cancel()
@@ -218,8 +242,8 @@ func TestServerDiscoveryRemoveClients(t *testing.T) {
 
 func TestServerDiscoveryOnlyChanges(t *testing.T) {
 	Convey("Publish msg only with changes", t, func() {
-		urlServ := "tcp://127.0.0.1:40007"
-		urlPubSub := "tcp://127.0.0.1:50007"
+		urlServ := "inproc://survey/07"
+		urlPubSub := "inproc://pubsub/07"
 
 		server, err := Server(urlServ, urlPubSub, defaultOpts)
 		So(err, ShouldBeNil)
@@ -240,9 +264,9 @@ func TestServerDiscoveryOnlyChanges(t *testing.T) {
 		So(err, ShouldBeNil)
 		clients := <-peers
 
-		So(clients, ShouldContain, "client1")
-		So(clients, ShouldContain, "client2")
-		So(clients, ShouldContain, "client3")
+		So(ids(clients), ShouldContain, "client1")
+		So(ids(clients), ShouldContain, "client2")
+		So(ids(clients), ShouldContain, "client3")
 
 		time.Sleep(100 * time.Millisecond)
 
@@ -264,8 +288,8 @@ func TestServerDiscoveryOnlyChanges(t *testing.T) {
 func TestClientAndSubError(t *testing.T) {
 	Convey("Client without subscribe gives an error if you call Peers", t, func() {
 
-		urlServ := "tcp://127.0.0.1:40008"
-		urlPubSub := "tcp://127.0.0.1:50008"
+		urlServ := "inproc://survey/08"
+		urlPubSub := "inproc://pubsub/08"
 
 		server, err := Server(urlServ, urlPubSub, defaultOpts)
 		So(err, ShouldBeNil)
@@ -285,8 +309,8 @@ func TestClientAndSubError(t *testing.T) {
 func TestClientAndIndependentSub(t *testing.T) {
 	Convey("Gets the changes from a Subscriber", t, func() {
 
-		urlServ := "tcp://127.0.0.1:40009"
-		urlPubSub := "tcp://127.0.0.1:50009"
+		urlServ := "inproc://survey/09"
+		urlPubSub := "inproc://pubsub/09"
 
 		server, err := Server(urlServ, urlPubSub, defaultOpts)
 		So(err, ShouldBeNil)
@@ -299,19 +323,798 @@ func TestClientAndIndependentSub(t *testing.T) {
 		So(err, ShouldBeNil)
 
 		clients := <-sub.Changes()
-		So(clients, ShouldContain, "client1")
+		So(ids(clients), ShouldContain, "client1")
+
+		server.Cancel()
+		cancel()
+		client.Cancel()
+
+	})
+}
+
+func TestServerDiscoveryRecords(t *testing.T) {
+	Convey("Discover the structured record of the clients", t, func() {
+		urlServ := "inproc://survey/12"
+		urlPubSub := "inproc://pubsub/12"
+
+		server, err := Server(urlServ, urlPubSub, defaultOpts)
+		So(err, ShouldBeNil)
+
+		record := ServiceRecord{
+			ID:       "cache-1",
+			Address:  "http://10.0.0.1:8080",
+			Service:  "cache",
+			Version:  "1.2.0",
+			Tags:     []string{"eu-west"},
+			Metadata: map[string]string{"weight": "10"},
+		}
+		client, err := ClientWithRecord(urlServ, urlPubSub, record)
+		So(err, ShouldBeNil)
+
+		peers, err := client.Peers()
+		So(err, ShouldBeNil)
+		clients := <-peers
+
+		So(clients, ShouldResemble, []ServiceRecord{record})
+
+		server.Cancel()
+		client.Cancel()
+
+	})
+}
+
+func TestSubscriberEvents(t *testing.T) {
+	Convey("Gets every single change from a Subscriber", t, func() {
+		urlServ := "inproc://survey/14"
+		urlPubSub := "inproc://pubsub/14"
+
+		server, err := Server(urlServ, urlPubSub, defaultOpts)
+		So(err, ShouldBeNil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		sub, err := NewSubscriber(ctx, urlPubSub)
+		So(err, ShouldBeNil)
+
+		clientOne, err := Client(urlServ, "client1")
+		So(err, ShouldBeNil)
+
+		event := <-sub.Events()
+		So(event.Type, ShouldEqual, Added)
+		So(event.Record.ID, ShouldEqual, "client1")
+		So(event.Revision, ShouldEqual, 1)
+
+		clientTwo, err := Client(urlServ, "client2")
+		So(err, ShouldBeNil)
+
+		event = <-sub.Events()
+		So(event.Type, ShouldEqual, Added)
+		So(event.Record.ID, ShouldEqual, "client2")
+		So(event.Revision, ShouldEqual, 2)
+
+		clientOne.Cancel()
+
+		event = <-sub.Events()
+		So(event.Type, ShouldEqual, Removed)
+		So(event.Record.ID, ShouldEqual, "client1")
+		So(event.Revision, ShouldEqual, 3)
+
+		server.Cancel()
+		cancel()
+		clientTwo.Cancel()
+
+	})
+}
+
+func TestSubscriberSnapshot(t *testing.T) {
+	Convey("A late Subscriber gets the current membership", t, func() {
+		urlServ := "inproc://survey/16"
+		urlPubSub := "inproc://pubsub/16"
+		opts := defaultOpts
+		opts.ControlURL = "inproc://control/16"
+
+		server, err := Server(urlServ, urlPubSub, opts)
+		So(err, ShouldBeNil)
+
+		clientOne, err := ClientWithSub(urlServ, urlPubSub, "client1")
+		So(err, ShouldBeNil)
+
+		peers, err := clientOne.Peers()
+		So(err, ShouldBeNil)
+		clients := <-peers
+		So(ids(clients), ShouldResemble, []string{"client1"})
+
+		// the membership is stable, nothing else is published
+		ctx, cancel := context.WithCancel(context.Background())
+		sub, err := NewSubscriberWithOptions(ctx, urlPubSub, SubscriberOptions{ControlURLs: []string{opts.ControlURL}})
+		So(err, ShouldBeNil)
+
+		clients = <-sub.Changes()
+		So(ids(clients), ShouldResemble, []string{"client1"})
+
+		event := <-sub.Events()
+		So(event.Type, ShouldEqual, Added)
+		So(event.Record.ID, ShouldEqual, "client1")
+
+		clientTwo, err := ClientWithOptions(urlServ, urlPubSub, ServiceRecord{ID: "client2", Address: "client2"},
+			ClientOptions{Subscriber: SubscriberOptions{ControlURLs: []string{opts.ControlURL}}})
+		So(err, ShouldBeNil)
+
+		peers, err = clientTwo.Peers()
+		So(err, ShouldBeNil)
+		clients = <-peers
+		So(ids(clients), ShouldContain, "client1")
+
+		clients = <-sub.Changes()
+		So(ids(clients), ShouldResemble, []string{"client1", "client2"})
+
+		server.Cancel()
+		cancel()
+		clientOne.Cancel()
+		clientTwo.Cancel()
+
+	})
+}
+
+func TestServerRepublish(t *testing.T) {
+	Convey("The server republishes the membership for late subscribers", t, func() {
+		urlServ := "inproc://survey/17"
+		urlPubSub := "inproc://pubsub/17"
+		opts := defaultOpts
+		opts.RepublishTime = 30 * time.Millisecond
+
+		server, err := Server(urlServ, urlPubSub, opts)
+		So(err, ShouldBeNil)
+
+		client, err := Client(urlServ, "client1")
+		So(err, ShouldBeNil)
+		time.Sleep(100 * time.Millisecond)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		sub, err := NewSubscriber(ctx, urlPubSub)
+		So(err, ShouldBeNil)
+
+		clients := <-sub.Changes()
+		So(ids(clients), ShouldResemble, []string{"client1"})
+
+		// the same revision is not delivered twice
+		time.Sleep(100 * time.Millisecond)
+		So(len(sub.Changes()), ShouldEqual, 0)
+
+		server.Cancel()
+		cancel()
+		client.Cancel()
+
+	})
+}
+
+func TestSubscriberServices(t *testing.T) {
+	Convey("A Subscriber only gets the services it subscribes to", t, func() {
+		urlServ := "inproc://survey/18"
+		urlPubSub := "inproc://pubsub/18"
+		opts := defaultOpts
+		opts.ControlURL = "inproc://control/18"
+
+		server, err := Server(urlServ, urlPubSub, opts)
+		So(err, ShouldBeNil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		caches, err := NewSubscriberWithOptions(ctx, urlPubSub, SubscriberOptions{Services: []string{"cache"}})
+		So(err, ShouldBeNil)
+		both, err := NewSubscriberWithOptions(ctx, urlPubSub, SubscriberOptions{Services: []string{"api", "cache"}})
+		So(err, ShouldBeNil)
+
+		api, err := ClientWithRecord(urlServ, "", ServiceRecord{ID: "api-1", Address: "api-1", Service: "api"})
+		So(err, ShouldBeNil)
+		clients := <-both.Changes()
+		So(ids(clients), ShouldResemble, []string{"api-1"})
+
+		cache, err := ClientWithRecord(urlServ, "", ServiceRecord{ID: "cache-1", Address: "cache-1", Service: "cache"})
+		So(err, ShouldBeNil)
+		clients = <-both.Changes()
+		So(ids(clients), ShouldResemble, []string{"api-1", "cache-1"})
+
+		clients = <-caches.Changes()
+		So(ids(clients), ShouldResemble, []string{"cache-1"})
+		event := <-caches.Events()
+		So(event.Type, ShouldEqual, Added)
+		So(event.Record.ID, ShouldEqual, "cache-1")
+
+		late, err := NewSubscriberWithOptions(ctx, urlPubSub,
+			SubscriberOptions{ControlURLs: []string{opts.ControlURL}, Services: []string{"api"}})
+		So(err, ShouldBeNil)
+		clients = <-late.Changes()
+		So(ids(clients), ShouldResemble, []string{"api-1"})
+
+		api.Cancel()
+		clients = <-both.Changes()
+		So(ids(clients), ShouldResemble, []string{"cache-1"})
+		clients = <-late.Changes()
+		So(clients, ShouldBeEmpty)
+
+		// nothing changed on the cache service
+		time.Sleep(100 * time.Millisecond)
+		So(len(caches.Changes()), ShouldEqual, 0)
+
+		server.Cancel()
+		cancel()
+		cache.Cancel()
+
+	})
+}
+
+func TestClusterFailover(t *testing.T) {
+	Convey("Losing a server does not change the membership", t, func() {
+		urlServA, urlPubSubA := "inproc://survey/19", "inproc://pubsub/19"
+		urlServB, urlPubSubB := "inproc://survey/20", "inproc://pubsub/20"
+		urlServers := []string{urlServA, urlServB}
+		urlPubSubs := []string{urlPubSubA, urlPubSubB}
+		opts := defaultOpts
+		opts.RepublishTime = 20 * time.Millisecond
+		opts.MaxMissedSurveys = 2
+
+		serverA, err := Server(urlServA, urlPubSubA, opts)
+		So(err, ShouldBeNil)
+
+		clientOne, err := ClusterClient(urlServers, nil, ServiceRecord{ID: "client1", Address: "client1"}, ClientOptions{})
+		So(err, ShouldBeNil)
+		clientTwo, err := ClusterClient(urlServers, nil, ServiceRecord{ID: "client2", Address: "client2"}, ClientOptions{})
+		So(err, ShouldBeNil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		sub, err := NewClusterSubscriber(ctx, urlPubSubs, SubscriberOptions{
+			Delivery:     LatestUpdate,
+			FailoverTime: 60 * time.Millisecond,
+		})
+		So(err, ShouldBeNil)
+
+		clients := <-sub.Changes()
+		for len(clients) < 2 {
+			clients = <-sub.Changes()
+		}
+		So(ids(clients), ShouldResemble, []string{"client1", "client2"})
+
+		// the Subscriber follows the server A, B joins later
+		serverB, err := Server(urlServB, urlPubSubB, opts)
+		So(err, ShouldBeNil)
+		time.Sleep(100 * time.Millisecond)
+
+		serverA.Cancel()
+		time.Sleep(200 * time.Millisecond)
+		So(len(sub.Changes()), ShouldEqual, 0)
+
+		// the changes come from server B
+		clientThree, err := ClusterClient(urlServers, nil, ServiceRecord{ID: "client3", Address: "client3"}, ClientOptions{})
+		So(err, ShouldBeNil)
+		clients = <-sub.Changes()
+		So(ids(clients), ShouldResemble, []string{"client1", "client2", "client3"})
+
+		serverB.Cancel()
+		cancel()
+		clientOne.Cancel()
+		clientTwo.Cancel()
+		clientThree.Cancel()
+
+	})
+}
+
+// testServices returns Services with a Publisher that only queues the updates
+func testServices(opt Options) (*Services, chan publication) {
+	publisher := &Publisher{lifecycle: lifecycle{ctx: context.Background()}, publishCh: make(chan publication, 100)}
+	return NewServices(publisher, opt), publisher.publishCh
+}
+
+// published returns the updates of the whole membership queued so far
+func published(ch chan publication) []Update {
+	var updates []Update
+	for len(ch) > 0 {
+		p := <-ch
+		if p.topic == allTopic {
+			updates = append(updates, p.update)
+		}
+	}
+	return updates
+}
+
+func TestServicesMissedSurveys(t *testing.T) {
+	Convey("A node is removed after missing too many SURVEYS", t, func() {
+		services, ch := testServices(Options{MaxMissedSurveys: 2})
+		a := ServiceRecord{ID: "a", Address: "a"}
+		b := ServiceRecord{ID: "b", Address: "b"}
+
+		services.Add(map[string]ServiceRecord{"a": a, "b": b})
+		So(published(ch), ShouldHaveLength, 1)
+
+		// b misses two SURVEYS and comes back, nothing changes
+		services.Add(map[string]ServiceRecord{"a": a})
+		services.Add(map[string]ServiceRecord{"a": a})
+		services.Add(map[string]ServiceRecord{"a": a, "b": b})
+		So(published(ch), ShouldBeEmpty)
+
+		// the third miss removes it
+		services.Add(map[string]ServiceRecord{"a": a})
+		services.Add(map[string]ServiceRecord{"a": a})
+		services.Add(map[string]ServiceRecord{"a": a})
+		updates := published(ch)
+		So(updates, ShouldHaveLength, 1)
+		So(updates[0].Records, ShouldResemble, []ServiceRecord{a})
+		So(updates[0].Events, ShouldResemble, []Event{{Type: Removed, Record: b, Revision: 2}})
+	})
+
+	Convey("Without tolerance a node is removed on the first miss", t, func() {
+		services, ch := testServices(Options{})
+		a := ServiceRecord{ID: "a", Address: "a"}
+
+		services.Add(map[string]ServiceRecord{"a": a})
+		services.Add(map[string]ServiceRecord{})
+		updates := published(ch)
+		So(updates, ShouldHaveLength, 2)
+		So(updates[1].Records, ShouldBeEmpty)
+	})
+}
+
+func TestServicesTTL(t *testing.T) {
+	Convey("A node is removed when the TTL expires", t, func() {
+		services, ch := testServices(Options{TTL: 50 * time.Millisecond})
+		a := ServiceRecord{ID: "a", Address: "a"}
+
+		services.Add(map[string]ServiceRecord{"a": a})
+		services.Add(map[string]ServiceRecord{})
+		So(published(ch), ShouldHaveLength, 1)
+
+		time.Sleep(60 * time.Millisecond)
+		services.Add(map[string]ServiceRecord{})
+		updates := published(ch)
+		So(updates, ShouldHaveLength, 1)
+		So(updates[0].Records, ShouldBeEmpty)
+	})
+}
+
+func TestServicesRestore(t *testing.T) {
+	Convey("The restored nodes are not removed during the warm up", t, func() {
+		dir, err := os.MkdirTemp("", "gopherdiscovery")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		store := NewFileStore(filepath.Join(dir, "state.json"))
+
+		a := ServiceRecord{ID: "a", Address: "a"}
+		b := ServiceRecord{ID: "b", Address: "b"}
+
+		services, ch := testServices(Options{Store: store})
+		services.Add(map[string]ServiceRecord{"a": a, "b": b})
+		before := published(ch)
+		So(before, ShouldHaveLength, 1)
+
+		// the server restarts
+		state, err := store.Load()
+		So(err, ShouldBeNil)
+		So(state.Nodes, ShouldHaveLength, 2)
+
+		services, ch = testServices(Options{Store: store})
+		services.Restore(state, 50*time.Millisecond)
+		So(services.Snapshot().Records, ShouldResemble, []ServiceRecord{a, b})
+		So(services.Snapshot().Origin, ShouldEqual, before[0].Origin)
+
+		// only a answers the first SURVEYS
+		services.Add(map[string]ServiceRecord{"a": a})
+		services.Add(map[string]ServiceRecord{"a": a})
+		So(published(ch), ShouldBeEmpty)
+
+		time.Sleep(60 * time.Millisecond)
+		services.Add(map[string]ServiceRecord{"a": a})
+		updates := published(ch)
+		So(updates, ShouldHaveLength, 1)
+		So(updates[0].Records, ShouldResemble, []ServiceRecord{a})
+		So(updates[0].Revision, ShouldEqual, 2)
+	})
+}
+
+func TestSharedKey(t *testing.T) {
+	Convey("The server rejects the responses without a valid signature", t, func() {
+		urlServ := "inproc://survey/28"
+		urlPubSub := "inproc://pubsub/28"
+		opts := defaultOpts
+		opts.SharedKey = []byte("secret")
+
+		server, err := Server(urlServ, urlPubSub, opts)
+		So(err, ShouldBeNil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		sub, err := NewSubscriber(ctx, urlPubSub)
+		So(err, ShouldBeNil)
+
+		good, err := ClientWithOptions(urlServ, "", ServiceRecord{ID: "good", Address: "good"},
+			ClientOptions{SharedKey: []byte("secret")})
+		So(err, ShouldBeNil)
+		forged, err := ClientWithOptions(urlServ, "", ServiceRecord{ID: "forged", Address: "forged"},
+			ClientOptions{SharedKey: []byte("guess")})
+		So(err, ShouldBeNil)
+		unsigned, err := Client(urlServ, "unsigned")
+		So(err, ShouldBeNil)
+
+		clients := <-sub.Changes()
+		So(ids(clients), ShouldResemble, []string{"good"})
+
+		So(waitFor(time.Second, func() bool { return server.Rejected() >= 2 }), ShouldBeTrue)
+
+		time.Sleep(100 * time.Millisecond)
+		So(len(sub.Changes()), ShouldEqual, 0)
+
+		server.Cancel()
+		cancel()
+		good.Cancel()
+		forged.Cancel()
+		unsigned.Cancel()
+
+	})
+}
+
+func TestSignedPublications(t *testing.T) {
+	Convey("The subscriber drops the publications not signed by the server", t, func() {
+		urlServ := "inproc://survey/29"
+		urlPubSub := "inproc://pubsub/29"
+		urlForged := "inproc://pubsub/30"
+		public, private, err := ed25519.GenerateKey(nil)
+		So(err, ShouldBeNil)
+		_, forgedKey, err := ed25519.GenerateKey(nil)
+		So(err, ShouldBeNil)
+
+		opts := defaultOpts
+		opts.ControlURL = "inproc://control/29"
+		opts.SigningKey = private
+		server, err := Server(urlServ, urlPubSub, opts)
+		So(err, ShouldBeNil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		forger, err := NewPublisherWithOptions(ctx, urlForged, PublisherOptions{SigningKey: forgedKey})
+		So(err, ShouldBeNil)
+
+		client, err := Client(urlServ, "good")
+		So(err, ShouldBeNil)
+		So(waitFor(time.Second, func() bool { return len(server.services.Snapshot().Records) == 1 }), ShouldBeTrue)
+
+		// the snapshot from the control endpoint is signed too
+		sub, err := NewClusterSubscriber(ctx, []string{urlPubSub, urlForged}, SubscriberOptions{
+			ControlURLs: []string{opts.ControlURL},
+			PublicKey:   public,
+		})
+		So(err, ShouldBeNil)
+
+		clients := <-sub.Changes()
+		So(ids(clients), ShouldResemble, []string{"good"})
+
+		evil := ServiceRecord{ID: "evil", Address: "evil"}
+		for i := 0; i < 5; i++ {
+			forger.Publish(Update{Origin: "forged", Revision: 100, Records: []ServiceRecord{evil}})
+		}
+		So(waitFor(time.Second, func() bool { return sub.Forged() > 0 }), ShouldBeTrue)
+
+		time.Sleep(100 * time.Millisecond)
+		So(len(sub.Changes()), ShouldEqual, 0)
+
+		server.Cancel()
+		cancel()
+		client.Cancel()
+	})
+}
+
+func TestAdmissionPolicy(t *testing.T) {
+	Convey("The server leaves out the nodes denied by the AdmissionPolicy", t, func() {
+		urlServ := "inproc://survey/31"
+		urlPubSub := "inproc://pubsub/31"
+		opts := defaultOpts
+		opts.Admission = AllOf{RegexpPolicy{ID: regexp.MustCompile(`^prod-`)}, MaxNodes(2)}
+
+		server, err := Server(urlServ, urlPubSub, opts)
+		So(err, ShouldBeNil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		sub, err := NewSubscriber(ctx, urlPubSub)
+		So(err, ShouldBeNil)
+
+		prod1, err := Client(urlServ, "prod-1")
+		So(err, ShouldBeNil)
+		clients := <-sub.Changes()
+		So(ids(clients), ShouldResemble, []string{"prod-1"})
+
+		dev, err := Client(urlServ, "dev-1")
+		So(err, ShouldBeNil)
+		prod2, err := Client(urlServ, "prod-2")
+		So(err, ShouldBeNil)
+		clients = <-sub.Changes()
+		So(ids(clients), ShouldResemble, []string{"prod-1", "prod-2"})
+
+		prod3, err := Client(urlServ, "prod-3")
+		So(err, ShouldBeNil)
+		So(waitFor(time.Second, func() bool { return server.Denied() >= 3 }), ShouldBeTrue)
+
+		time.Sleep(100 * time.Millisecond)
+		So(len(sub.Changes()), ShouldEqual, 0)
+
+		server.Cancel()
+		cancel()
+		prod1.Cancel()
+		prod2.Cancel()
+		prod3.Cancel()
+		dev.Cancel()
+	})
+}
+
+func TestMixedCodecs(t *testing.T) {
+	Convey("Servers, clients and subscribers with different codecs understand each other", t, func() {
+		urlServ := "inproc://survey/33"
+		urlPubSub := "inproc://pubsub/33"
+		opts := defaultOpts
+		opts.Codec = ProtobufCodec
+
+		server, err := Server(urlServ, urlPubSub, opts)
+		So(err, ShouldBeNil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		sub, err := NewSubscriber(ctx, urlPubSub)
+		So(err, ShouldBeNil)
+
+		record := ServiceRecord{ID: "api-1", Address: "http://10.0.0.1:8080", Service: "api", Tags: []string{"v2"}}
+		client, err := ClientWithOptions(urlServ, "", record, ClientOptions{Codec: MsgpackCodec})
+		So(err, ShouldBeNil)
+
+		clients := <-sub.Changes()
+		So(clients, ShouldResemble, []ServiceRecord{record})
 
 		server.Cancel()
 		cancel()
 		client.Cancel()
+	})
+}
+
+func TestExcludeUnhealthy(t *testing.T) {
+	Convey("The nodes with critical health leave the membership until they recover", t, func() {
+		urlServ := "inproc://survey/34"
+		urlPubSub := "inproc://pubsub/34"
+		opts := defaultOpts
+		opts.ExcludeUnhealthy = true
+
+		server, err := Server(urlServ, urlPubSub, opts)
+		So(err, ShouldBeNil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		sub, err := NewSubscriber(ctx, urlPubSub)
+		So(err, ShouldBeNil)
 
+		var health atomic.Value
+		health.Store(HealthPassing)
+		client, err := ClientWithOptions(urlServ, "", ServiceRecord{ID: "a", Address: "a"}, ClientOptions{
+			HealthCheck:    func() HealthStatus { return health.Load().(HealthStatus) },
+			HealthInterval: 10 * time.Millisecond,
+		})
+		So(err, ShouldBeNil)
+
+		clients := <-sub.Changes()
+		So(clients, ShouldResemble, []ServiceRecord{{ID: "a", Address: "a", Health: HealthPassing}})
+
+		health.Store(HealthWarning)
+		clients = <-sub.Changes()
+		So(clients, ShouldResemble, []ServiceRecord{{ID: "a", Address: "a", Health: HealthWarning}})
+
+		health.Store(HealthCritical)
+		clients = <-sub.Changes()
+		So(clients, ShouldBeEmpty)
+
+		health.Store(HealthPassing)
+		clients = <-sub.Changes()
+		So(ids(clients), ShouldResemble, []string{"a"})
+
+		server.Cancel()
+		cancel()
+		client.Cancel()
+	})
+}
+
+func TestServerProbes(t *testing.T) {
+	Convey("The server publishes the health of the probes", t, func() {
+		urlServ := "inproc://survey/35"
+		urlPubSub := "inproc://pubsub/35"
+		var hung atomic.Value
+		hung.Store(false)
+		opts := defaultOpts
+		opts.ProbeInterval = 10 * time.Millisecond
+		opts.ProbeConcurrency = 2
+		opts.Prober = ProberFunc(func(r ServiceRecord) HealthStatus {
+			if r.ID == "b" && hung.Load().(bool) {
+				return HealthCritical
+			}
+			return HealthPassing
+		})
+
+		server, err := Server(urlServ, urlPubSub, opts)
+		So(err, ShouldBeNil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		sub, err := NewSubscriberWithOptions(ctx, urlPubSub, SubscriberOptions{Delivery: LatestUpdate})
+		So(err, ShouldBeNil)
+
+		a, err := Client(urlServ, "a")
+		So(err, ShouldBeNil)
+		b, err := Client(urlServ, "b")
+		So(err, ShouldBeNil)
+
+		passing := []ServiceRecord{
+			{ID: "a", Address: "a", Health: HealthPassing},
+			{ID: "b", Address: "b", Health: HealthPassing},
+		}
+		So(waitFor(time.Second, func() bool {
+			return reflect.DeepEqual(server.services.Snapshot().Records, passing)
+		}), ShouldBeTrue)
+
+		hung.Store(true)
+		critical := []ServiceRecord{
+			{ID: "a", Address: "a", Health: HealthPassing},
+			{ID: "b", Address: "b", Health: HealthCritical},
+		}
+		So(waitFor(time.Second, func() bool {
+			return reflect.DeepEqual(server.services.Snapshot().Records, critical)
+		}), ShouldBeTrue)
+
+		// the subscriber keeps the latest membership
+		time.Sleep(50 * time.Millisecond)
+		clients := <-sub.Changes()
+		So(clients, ShouldResemble, critical)
+
+		server.Cancel()
+		cancel()
+		a.Cancel()
+		b.Cancel()
+	})
+}
+
+func TestGracefulLeave(t *testing.T) {
+	Convey("The server removes a client that leaves right away", t, func() {
+		urlServ := "inproc://survey/36"
+		urlPubSub := "inproc://pubsub/36"
+		opts := defaultOpts
+		// without the leave the node would stay for a long time
+		opts.MaxMissedSurveys = 1000
+		opts.SharedKey = []byte("secret")
+
+		server, err := Server(urlServ, urlPubSub, opts)
+		So(err, ShouldBeNil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		sub, err := NewSubscriber(ctx, urlPubSub)
+		So(err, ShouldBeNil)
+
+		clientOne, err := ClientWithOptions(urlServ, "", ServiceRecord{ID: "client1", Address: "client1"},
+			ClientOptions{SharedKey: []byte("secret")})
+		So(err, ShouldBeNil)
+		clients := <-sub.Changes()
+		So(ids(clients), ShouldResemble, []string{"client1"})
+
+		clientTwo, err := ClientWithOptions(urlServ, "", ServiceRecord{ID: "client2", Address: "client2"},
+			ClientOptions{SharedKey: []byte("secret")})
+		So(err, ShouldBeNil)
+		clients = <-sub.Changes()
+		So(ids(clients), ShouldResemble, []string{"client1", "client2"})
+
+		start := time.Now()
+		clientOne.Cancel()
+		So(time.Since(start), ShouldBeLessThan, DefaultLeaveTimeout)
+
+		// removed by the leave, not after missing the SURVEYS
+		clients, ok := changesWithin(sub.Changes(), 10*opts.PollTime)
+		So(ok, ShouldBeTrue)
+		So(ids(clients), ShouldResemble, []string{"client2"})
+		event := <-sub.Events()
+		for event.Type != Removed {
+			event = <-sub.Events()
+		}
+		So(event.Record.ID, ShouldEqual, "client1")
+
+		// the goroutines have finished and the client is stopped
+		_, ok = <-clientOne.servers[0].done
+		So(ok, ShouldBeFalse)
+		So(clientOne.ctx.Err(), ShouldNotBeNil)
+
+		// Cancel can be called again
+		clientOne.Cancel()
+
+		server.Cancel()
+		cancel()
+		clientTwo.Cancel()
+	})
+
+	Convey("The client leaves every server, even if one surveys more often", t, func() {
+		urlServA := "inproc://survey/46"
+		urlServB := "inproc://survey/47"
+		optsA := defaultOpts
+		optsA.MaxMissedSurveys = 1000
+		optsB := optsA
+		optsB.PollTime = 5 * optsA.PollTime
+
+		serverA, err := Server(urlServA, "inproc://pubsub/46", optsA)
+		So(err, ShouldBeNil)
+		serverB, err := Server(urlServB, "inproc://pubsub/47", optsB)
+		So(err, ShouldBeNil)
+
+		client, err := ClusterClient([]string{urlServA, urlServB}, nil, ServiceRecord{ID: "client1", Address: "client1"}, ClientOptions{})
+		So(err, ShouldBeNil)
+		joined := waitFor(20*optsB.PollTime, func() bool {
+			return len(serverA.services.Snapshot().Records) == 1 && len(serverB.services.Snapshot().Records) == 1
+		})
+		So(joined, ShouldBeTrue)
+
+		start := time.Now()
+		client.Cancel()
+		So(time.Since(start), ShouldBeLessThan, DefaultLeaveTimeout)
+		// the leave is sent, the servers remove the client once they read it
+		left := waitFor(optsA.PollTime, func() bool {
+			return len(serverA.services.Snapshot().Records) == 0 && len(serverB.services.Snapshot().Records) == 0
+		})
+		So(left, ShouldBeTrue)
+
+		serverA.Cancel()
+		serverB.Cancel()
+	})
+
+	Convey("The client leaves a server that surveys less often than the LeaveTimeout", t, func() {
+		urlServ := "inproc://survey/51"
+		urlPubSub := "inproc://pubsub/51"
+		opts := defaultOpts
+		opts.PollTime = 300 * time.Millisecond
+		opts.MaxMissedSurveys = 1000
+
+		server, err := Server(urlServ, urlPubSub, opts)
+		So(err, ShouldBeNil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		sub, err := NewSubscriber(ctx, urlPubSub)
+		So(err, ShouldBeNil)
+
+		client, err := ClientWithOptions(urlServ, "", ServiceRecord{ID: "client1", Address: "client1"},
+			ClientOptions{LeaveTimeout: 100 * time.Millisecond})
+		So(err, ShouldBeNil)
+		clients := <-sub.Changes()
+		So(ids(clients), ShouldResemble, []string{"client1"})
+		// one more SURVEY, the client knows how often they come
+		time.Sleep(opts.PollTime + 50*time.Millisecond)
+
+		So(client.Close(), ShouldBeNil)
+		clients, ok := changesWithin(sub.Changes(), 100*time.Millisecond)
+		So(ok, ShouldBeTrue)
+		So(clients, ShouldBeEmpty)
+
+		server.Cancel()
+		cancel()
+	})
+
+	Convey("The client does not wait to leave a closed server", t, func() {
+		urlServ := "inproc://survey/53"
+
+		server, err := Server(urlServ, "inproc://pubsub/53", defaultOpts)
+		So(err, ShouldBeNil)
+		client, err := Client(urlServ, "client1")
+		So(err, ShouldBeNil)
+		joined := waitFor(20*defaultOpts.PollTime, func() bool {
+			return len(server.services.Snapshot().Records) == 1
+		})
+		So(joined, ShouldBeTrue)
+
+		server.Cancel()
+		start := time.Now()
+		client.Cancel()
+		So(time.Since(start), ShouldBeLessThan, DefaultLeaveTimeout/4)
+	})
+}
+
+func TestClientRecordWithoutID(t *testing.T) {
+	Convey("A record without ID gives an error", t, func() {
+		_, err := ClientWithRecord("inproc://survey/13", "", ServiceRecord{Address: "http://10.0.0.1:8080"})
+		So(err, ShouldNotBeNil)
 	})
 }
 
 func TestBadUrlServer(t *testing.T) {
 	Convey("Discovery with bad url", t, func() {
 		urlServ := "tcp://xxx"
-		urlPubSub := "tcp://127.0.0.1:50010"
+		urlPubSub := "inproc://pubsub/10"
 
 		_, err := Server(urlServ, urlPubSub, defaultOpts)
 		So(err, ShouldNotBeNil)
@@ -324,7 +1127,7 @@ func TestBadUrlServer(t *testing.T) {
 
 func TestBadUrlPubSub(t *testing.T) {
 	Convey("Discovery with bad url", t, func() {
-		urlServ := "tcp://127.0.0.1:40011"
+		urlServ := "inproc://survey/11"
 		urlPubSub := "tcp://xxx"
 
 		_, err := Server(urlServ, urlPubSub, defaultOpts)
@@ -0,0 +1,78 @@
+package gopherdiscovery
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// StateStore keeps the membership of a server across restarts. Every server
+// needs its own store.
+type StateStore interface {
+	// Load returns the saved state, an empty State if there is none
+	Load() (State, error)
+	Save(state State) error
+}
+
+// State is the membership of a server
+type State struct {
+	Origin   string      `json:"origin"`
+	Revision uint64      `json:"revision"`
+	Nodes    []NodeState `json:"nodes"`
+}
+
+// NodeState is a node of the membership and the last time it answered a SURVEY
+type NodeState struct {
+	Record   ServiceRecord `json:"record"`
+	LastSeen time.Time     `json:"last_seen"`
+}
+
+// FileStore saves the State as JSON in a file
+type FileStore struct {
+	path string
+}
+
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+func (f *FileStore) Load() (State, error) {
+	var state State
+
+	data, err := os.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
+
+// Save writes the State to a temporary file and renames it, so the file is
+// never left half written
+func (f *FileStore) Save(state State) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
@@ -0,0 +1,36 @@
+package gopherdiscovery
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFileStore(t *testing.T) {
+	Convey("The FileStore saves and loads the State", t, func() {
+		dir, err := os.MkdirTemp("", "gopherdiscovery")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		store := NewFileStore(filepath.Join(dir, "state.json"))
+
+		state, err := store.Load()
+		So(err, ShouldBeNil)
+		So(state, ShouldResemble, State{})
+
+		seen := time.Date(2015, 6, 1, 10, 0, 0, 0, time.UTC)
+		state = State{
+			Origin:   "origin",
+			Revision: 12,
+			Nodes:    []NodeState{{Record: ServiceRecord{ID: "a", Address: "a"}, LastSeen: seen}},
+		}
+		So(store.Save(state), ShouldBeNil)
+
+		loaded, err := store.Load()
+		So(err, ShouldBeNil)
+		So(loaded, ShouldResemble, state)
+	})
+}
@@ -0,0 +1,517 @@
+package gopherdiscovery
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/gdamore/mangos"
+	"github.com/gdamore/mangos/protocol/sub"
+)
+
+// DeliveryMode is how the Subscriber hands the changes to a consumer that is
+// not ready to receive them
+type DeliveryMode int
+
+const (
+	// DropUpdates discards the changes when the channel is full, a slow
+	// consumer can miss the latest membership
+	DropUpdates DeliveryMode = iota
+	// LatestUpdate coalesces the pending changes, Changes always ends up
+	// holding the newest membership. Events are still discarded when the
+	// channel is full.
+	LatestUpdate
+	// BlockingUpdates waits for the consumer to read Changes (and Events once
+	// it has been called), the Subscriber stops reading from the socket
+	// meanwhile
+	BlockingUpdates
+)
+
+type SubscriberOptions struct {
+	// Delivery of the changes to the consumer, DropUpdates by default
+	Delivery DeliveryMode
+
+	// ControlURLs of the servers, if present the Subscriber delivers the
+	// current membership before streaming the changes. They are tried in
+	// order until one of them answers
+	ControlURLs []string
+	// SnapshotTimeout is the time to wait for the current membership,
+	// DefaultSnapshotTimeout if 0
+	SnapshotTimeout time.Duration
+
+	// Services to subscribe to, for example []string{"cache"}. The
+	// Subscriber gets the whole membership if empty
+	Services []string
+
+	// FailoverTime is the time without publications from the server the
+	// Subscriber follows before it follows another one, DefaultFailoverTime
+	// if 0. Set the RepublishTime of the servers below it.
+	FailoverTime time.Duration
+
+	Transport TransportOptions
+
+	// PublicKey verifies the signature of the publications and of the
+	// current membership, the forged ones are dropped. Disabled if nil
+	PublicKey ed25519.PublicKey
+
+	// Logger of the Subscriber, StdLogger if nil
+	Logger Logger
+
+	// Metrics of the updates received and dropped. Disabled if nil
+	Metrics Metrics
+
+	// Legacy accepts the membership of the old publishers, the addresses
+	// joined with '|', while they are migrated. It is the whole membership,
+	// so it is ignored when subscribed to some Services. Not allowed with a
+	// PublicKey, those publications are not signed
+	Legacy bool
+}
+
+// DefaultFailoverTime is the time a Subscriber waits for a silent server
+// before following another one
+const DefaultFailoverTime = 3 * time.Second
+
+type Subscriber struct {
+	// urls for the Pub/Sub, one for every server
+	urls []string
+
+	opt     SubscriberOptions
+	logger  Logger
+	metrics Metrics
+
+	lifecycle
+	sock mangos.Socket
+
+	changes chan []ServiceRecord
+	events  chan Event
+
+	// set to 1 when the consumer asks for the Events channel
+	eventsRequested int32
+	// number of publications dropped because of their signature
+	forged uint64
+
+	// server followed on every topic
+	following map[string]following
+	// membership delivered on every topic
+	members map[string][]ServiceRecord
+	// latest update of another server on every topic, delivered if the
+	// followed one stays silent
+	pending map[string]Update
+	// receive deadline of the socket, set while there are pending updates
+	deadline time.Duration
+	// revision of the last legacy membership
+	legacyRevision uint64
+}
+
+// following is the server the Subscriber follows on a topic, the updates of
+// the rest of the servers are ignored while it keeps publishing
+type following struct {
+	origin   string
+	revision uint64
+	// last time the origin published on the topic
+	heard time.Time
+}
+
+func NewSubscriber(ctx context.Context, url string) (*Subscriber, error) {
+	return NewSubscriberWithOptions(ctx, url, SubscriberOptions{})
+}
+
+func NewSubscriberWithOptions(ctx context.Context, url string, opt SubscriberOptions) (*Subscriber, error) {
+	return NewClusterSubscriber(ctx, []string{url}, opt)
+}
+
+// NewClusterSubscriber subscribes to the Pub/Sub of every server, it follows
+// one of them and fails over to another when it goes silent
+func NewClusterSubscriber(ctx context.Context, urls []string, opt SubscriberOptions) (*Subscriber, error) {
+	var sock mangos.Socket
+	var err error
+
+	if len(urls) == 0 {
+		return nil, errors.New("No subscribe url is provided")
+	}
+
+	sock, err = sub.NewSocket()
+	if err != nil {
+		return nil, err
+	}
+	err = addTransports(sock, opt.Transport)
+	if err != nil {
+		sock.Close()
+		return nil, err
+	}
+
+	for _, url := range urls {
+		err = dial(sock, url, opt.Transport)
+		if err != nil {
+			sock.Close()
+			return nil, err
+		}
+	}
+	subscriber := newSubscriber(ctx, urls, opt)
+	subscriber.sock = sock
+
+	for _, topic := range subscriber.topics() {
+		err = sock.SetOption(mangos.OptionSubscribe, subscription(topic))
+		if err != nil {
+			sock.Close()
+			return nil, err
+		}
+	}
+	if subscriber.legacy() {
+		// the legacy publications have no topic
+		err = sock.SetOption(mangos.OptionSubscribe, []byte{})
+		if err != nil {
+			sock.Close()
+			return nil, err
+		}
+	}
+
+	subscriber.closeOnDone(sock)
+	subscriber.goRun(subscriber.run)
+	return subscriber, nil
+}
+
+// Close stops the Subscriber, it closes the socket and the channels and waits
+// for the goroutines
+func (s *Subscriber) Close() error {
+	return s.close()
+}
+
+func newSubscriber(ctx context.Context, urls []string, opt SubscriberOptions) *Subscriber {
+	size := 8
+	if opt.Delivery == LatestUpdate {
+		// only the newest membership is kept
+		size = 1
+	}
+
+	s := &Subscriber{
+		urls:      urls,
+		opt:       opt,
+		logger:    newLogger(opt.Logger),
+		metrics:   orNoMetrics(opt.Metrics),
+		changes:   make(chan []ServiceRecord, size),
+		events:    make(chan Event, 64),
+		following: make(map[string]following),
+		members:   make(map[string][]ServiceRecord),
+		pending:   make(map[string]Update),
+	}
+	s.init(ctx)
+	return s
+}
+
+// topics returns the topics the Subscriber is interested in
+func (s *Subscriber) topics() []string {
+	if len(s.opt.Services) == 0 {
+		return []string{allTopic}
+	}
+
+	var topics []string
+	for _, service := range s.opt.Services {
+		topics = append(topics, serviceTopic(service))
+	}
+	return topics
+}
+
+// legacy reports whether the Subscriber accepts the legacy publications
+func (s *Subscriber) legacy() bool {
+	return s.opt.Legacy && len(s.opt.Services) == 0 && s.opt.PublicKey == nil
+}
+
+func (s *Subscriber) subscribed(topic string) bool {
+	for _, t := range s.topics() {
+		if t == topic {
+			return true
+		}
+	}
+	return false
+}
+
+// legacyUpdate turns the legacy membership into an update, the old
+// publishers only published when the membership changed so every one of them
+// is a new revision
+func (s *Subscriber) legacyUpdate(msg []byte) Update {
+	s.legacyRevision++
+	records := decodeLegacyMembership(msg)
+	return Update{
+		Origin:   legacyOrigin,
+		Revision: s.legacyRevision,
+		Records:  records,
+		Events:   diff(indexRecords(s.members[allTopic]), indexRecords(records), s.legacyRevision),
+	}
+}
+
+// Changes delivers the full membership every time it changes
+func (s *Subscriber) Changes() chan []ServiceRecord {
+	return s.changes
+}
+
+// Events delivers every single change (Added, Removed, Updated) of the membership
+func (s *Subscriber) Events() chan Event {
+	atomic.StoreInt32(&s.eventsRequested, 1)
+	return s.events
+}
+
+// Forged returns the number of publications dropped because they were not
+// signed or the signature was not valid
+func (s *Subscriber) Forged() uint64 {
+	return atomic.LoadUint64(&s.forged)
+}
+
+func (s *Subscriber) run() {
+	var msg []byte
+	var topic string
+	var update Update
+	var err error
+	var backoff time.Duration
+
+	if len(s.opt.ControlURLs) > 0 {
+		s.snapshot()
+	}
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			close(s.changes)
+			close(s.events)
+			return
+		default:
+			s.setDeadline(time.Now())
+			msg, err = s.sock.Recv()
+			if err == mangos.ErrRecvTimeout {
+				s.failover(time.Now())
+				continue
+			}
+			if err != nil {
+				if s.ctx.Err() == nil {
+					// a broken socket fails right away, wait before the
+					// next receive
+					s.logger.Error("DiscoveryClient: Cannot SUBSCRIBE to the changes", "urls", s.urls, "error", err)
+					backoff = nextBackoff(backoff)
+					sleep(s.ctx, backoff)
+				}
+				continue
+			}
+			backoff = 0
+			topic, update, err = decodePublication(msg, s.opt.PublicKey)
+			if err == ErrMissingTopic && s.legacy() {
+				topic, update, err = allTopic, s.legacyUpdate(msg), nil
+			}
+			if err == nil && !s.subscribed(topic) {
+				// every topic arrives with the legacy subscription
+				continue
+			}
+			if err == ErrNotSigned || err == ErrBadSignature {
+				atomic.AddUint64(&s.forged, 1)
+				s.logger.Warn("DiscoveryClient: Dropped forged changes", "urls", s.urls, "topic", topic, "error", err)
+				continue
+			}
+			if err != nil {
+				s.logger.Warn("DiscoveryClient: Cannot decode the changes", "urls", s.urls, "error", err)
+				continue
+			}
+
+			update, ok := s.accept(topic, update, time.Now())
+			if !ok {
+				continue
+			}
+			s.apply(topic, update)
+		}
+	}
+}
+
+// apply delivers the accepted update on the topic
+func (s *Subscriber) apply(topic string, update Update) {
+	s.metrics.Add(MetricUpdatesReceived, 1)
+	// the update may only have one service, deliver all the subscribed ones
+	s.members[topic] = update.Records
+	update.Records = s.merge()
+	s.deliver(update)
+}
+
+// setDeadline makes the receive time out when the first pending update is
+// due, so it is delivered even if no more publications arrive
+func (s *Subscriber) setDeadline(now time.Time) {
+	var deadline time.Duration
+	for topic := range s.pending {
+		due := s.following[topic].heard.Add(s.failoverTime()).Sub(now)
+		if due <= 0 {
+			due = time.Millisecond
+		}
+		if deadline == 0 || due < deadline {
+			deadline = due
+		}
+	}
+	if deadline == s.deadline {
+		return
+	}
+	err := s.sock.SetOption(mangos.OptionRecvDeadline, deadline)
+	if err != nil {
+		s.logger.Warn("DiscoveryClient: Cannot set the receive deadline", "urls", s.urls, "error", err)
+		return
+	}
+	s.deadline = deadline
+}
+
+// failover delivers the pending updates of the topics whose followed server
+// has been silent for the FailoverTime
+func (s *Subscriber) failover(now time.Time) {
+	for topic, update := range s.pending {
+		if now.Sub(s.following[topic].heard) <= s.failoverTime() {
+			continue
+		}
+		update, ok := s.accept(topic, update, now)
+		if ok {
+			s.apply(topic, update)
+		}
+	}
+}
+
+// snapshot delivers the current membership as if all the nodes were just added
+func (s *Subscriber) snapshot() {
+	var update Update
+	var err error
+
+	for _, url := range s.opt.ControlURLs {
+		update, err = fetchSnapshot(url, s.opt)
+		if err == nil {
+			break
+		}
+		s.logger.Warn("DiscoveryClient: Cannot get the current membership", "url", url, "error", err)
+	}
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	for _, topic := range s.topics() {
+		s.following[topic] = following{origin: update.Origin, revision: update.Revision, heard: now}
+		s.members[topic] = nil
+		service, perService := topicService(topic)
+		for _, record := range update.Records {
+			if !perService || record.Service == service {
+				s.members[topic] = append(s.members[topic], record)
+			}
+		}
+	}
+
+	for _, record := range update.Records {
+		update.Events = append(update.Events, Event{Type: Added, Record: record, Revision: update.Revision})
+	}
+	s.deliver(update)
+}
+
+// accept decides if the update on the topic has to be delivered. The updates
+// of the followed server are delivered if they are newer than the last one,
+// the rest of the servers are ignored unless the followed one goes silent. In
+// that case the Subscriber follows the new server, and the events are the
+// differences with the membership delivered so far. The latest update of the
+// rest of the servers is kept pending, a restarted server with a new origin
+// may not publish again until its membership changes.
+func (s *Subscriber) accept(topic string, update Update, now time.Time) (Update, bool) {
+	f, ok := s.following[topic]
+
+	switch {
+	case ok && update.Origin == f.origin:
+		if update.Revision <= f.revision {
+			f.heard = now
+			s.following[topic] = f
+			return update, false
+		}
+		if update.Revision != f.revision+1 {
+			// missed some publications, their events are lost
+			update.Events = diff(indexRecords(s.members[topic]), indexRecords(update.Records), update.Revision)
+		}
+
+	case ok && now.Sub(f.heard) <= s.failoverTime():
+		p, pending := s.pending[topic]
+		if !pending || p.Origin != update.Origin || p.Revision < update.Revision {
+			s.pending[topic] = update
+		}
+		return update, false
+
+	default:
+		update.Events = diff(indexRecords(s.members[topic]), indexRecords(update.Records), update.Revision)
+	}
+
+	s.following[topic] = following{origin: update.Origin, revision: update.Revision, heard: now}
+	if p, pending := s.pending[topic]; pending && p.Origin == update.Origin {
+		delete(s.pending, topic)
+	}
+	if ok && update.Origin != f.origin && len(update.Events) == 0 {
+		// same membership on the new server, nothing to deliver
+		return update, false
+	}
+	return update, true
+}
+
+func (s *Subscriber) failoverTime() time.Duration {
+	if s.opt.FailoverTime == 0 {
+		return DefaultFailoverTime
+	}
+	return s.opt.FailoverTime
+}
+
+// merge returns the membership of all the subscribed services ordered by ID
+func (s *Subscriber) merge() []ServiceRecord {
+	nodes := make(map[string]ServiceRecord)
+	for _, records := range s.members {
+		for _, record := range records {
+			nodes[record.ID] = record
+		}
+	}
+	return sortRecords(nodes)
+}
+
+// deliver hands the update to the consumer following the DeliveryMode
+func (s *Subscriber) deliver(update Update) {
+	switch s.opt.Delivery {
+	case BlockingUpdates:
+		select {
+		case s.changes <- update.Records:
+		case <-s.ctx.Done():
+			return
+		}
+		if atomic.LoadInt32(&s.eventsRequested) == 0 {
+			return
+		}
+		for _, event := range update.Events {
+			select {
+			case s.events <- event:
+			case <-s.ctx.Done():
+				return
+			}
+		}
+		return
+
+	case LatestUpdate:
+		// the Subscriber is the only sender, once the stale membership is
+		// discarded there is room for the newest one
+		select {
+		case s.changes <- update.Records:
+		default:
+			select {
+			case <-s.changes:
+				s.metrics.Add(MetricUpdatesDropped, 1)
+			default:
+			}
+			s.changes <- update.Records
+		}
+
+	default:
+		// non-blocking send to the channel, discards changes if the channel is not ready
+		select {
+		case s.changes <- update.Records:
+		default:
+			s.metrics.Add(MetricUpdatesDropped, 1)
+		}
+	}
+
+	for _, event := range update.Events {
+		select {
+		case s.events <- event:
+		default:
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package gopherdiscovery
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gdamore/mangos/protocol/pub"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func updateWith(revision uint64, n int) Update {
+	var records []ServiceRecord
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("client%d", i)
+		records = append(records, ServiceRecord{ID: id, Address: id})
+	}
+	return Update{Revision: revision, Records: records}
+}
+
+func TestSubscriberDelivery(t *testing.T) {
+	Convey("DropUpdates discards the newest membership when the consumer is slow", t, func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s := newSubscriber(ctx, nil, SubscriberOptions{Delivery: DropUpdates})
+
+		for i := 1; i <= 20; i++ {
+			s.deliver(updateWith(uint64(i), i))
+		}
+
+		var last []ServiceRecord
+		for len(s.changes) > 0 {
+			last = <-s.changes
+		}
+		So(len(last), ShouldBeLessThan, 20)
+	})
+
+	Convey("LatestUpdate always keeps the newest membership", t, func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s := newSubscriber(ctx, nil, SubscriberOptions{Delivery: LatestUpdate})
+
+		for i := 1; i <= 20; i++ {
+			s.deliver(updateWith(uint64(i), i))
+		}
+
+		last := <-s.Changes()
+		So(len(last), ShouldEqual, 20)
+		So(len(s.Changes()), ShouldEqual, 0)
+	})
+
+	Convey("BlockingUpdates delivers every membership to a slow consumer", t, func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s := newSubscriber(ctx, nil, SubscriberOptions{Delivery: BlockingUpdates})
+
+		go func() {
+			for i := 1; i <= 20; i++ {
+				s.deliver(updateWith(uint64(i), i))
+			}
+		}()
+
+		for i := 1; i <= 20; i++ {
+			time.Sleep(time.Millisecond)
+			records := <-s.Changes()
+			So(len(records), ShouldEqual, i)
+		}
+	})
+
+	Convey("BlockingUpdates does not wait on Events nobody asked for", t, func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s := newSubscriber(ctx, nil, SubscriberOptions{Delivery: BlockingUpdates})
+
+		done := make(chan struct{})
+		go func() {
+			for i := 1; i <= 100; i++ {
+				update := updateWith(uint64(i), 1)
+				update.Events = []Event{{Type: Updated, Record: update.Records[0], Revision: uint64(i)}}
+				s.deliver(update)
+			}
+			close(done)
+		}()
+
+		for i := 1; i <= 100; i++ {
+			<-s.Changes()
+		}
+		<-done
+	})
+}
+
+func TestSubscriberFailover(t *testing.T) {
+	Convey("The Subscriber follows one server and fails over when it goes silent", t, func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s := newSubscriber(ctx, nil, SubscriberOptions{FailoverTime: time.Second})
+		now := time.Now()
+		a := ServiceRecord{ID: "a", Address: "a"}
+		b := ServiceRecord{ID: "b", Address: "b"}
+
+		update, ok := s.accept(allTopic, Update{Origin: "one", Revision: 4, Records: []ServiceRecord{a}}, now)
+		So(ok, ShouldBeTrue)
+		So(update.Events, ShouldResemble, []Event{{Type: Added, Record: a, Revision: 4}})
+		s.members[allTopic] = update.Records
+
+		// old revisions and other servers are ignored
+		_, ok = s.accept(allTopic, Update{Origin: "one", Revision: 4, Records: []ServiceRecord{a}}, now)
+		So(ok, ShouldBeFalse)
+		_, ok = s.accept(allTopic, Update{Origin: "two", Revision: 9, Records: []ServiceRecord{a, b}}, now)
+		So(ok, ShouldBeFalse)
+
+		// the same membership on the new server is not delivered again
+		later := now.Add(2 * time.Second)
+		_, ok = s.accept(allTopic, Update{Origin: "two", Revision: 9, Records: []ServiceRecord{a}}, later)
+		So(ok, ShouldBeFalse)
+		So(s.following[allTopic].origin, ShouldEqual, "two")
+
+		update, ok = s.accept(allTopic, Update{Origin: "two", Revision: 10, Records: []ServiceRecord{a, b},
+			Events: []Event{{Type: Added, Record: b, Revision: 10}}}, later)
+		So(ok, ShouldBeTrue)
+		So(update.Events, ShouldResemble, []Event{{Type: Added, Record: b, Revision: 10}})
+	})
+
+	Convey("The Subscriber rebuilds the events when it misses a publication", t, func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s := newSubscriber(ctx, nil, SubscriberOptions{})
+		now := time.Now()
+		a := ServiceRecord{ID: "a", Address: "a"}
+		b := ServiceRecord{ID: "b", Address: "b"}
+		c := ServiceRecord{ID: "c", Address: "c"}
+
+		update, ok := s.accept(allTopic, Update{Origin: "one", Revision: 1, Records: []ServiceRecord{a, b}}, now)
+		So(ok, ShouldBeTrue)
+		s.members[allTopic] = update.Records
+
+		// revision 2 removed b and revision 3 added c, only 3 arrives
+		update, ok = s.accept(allTopic, Update{Origin: "one", Revision: 3, Records: []ServiceRecord{a, c},
+			Events: []Event{{Type: Added, Record: c, Revision: 3}}}, now)
+		So(ok, ShouldBeTrue)
+		So(update.Events, ShouldResemble, []Event{
+			{Type: Added, Record: c, Revision: 3},
+			{Type: Removed, Record: b, Revision: 3},
+		})
+	})
+}
+
+func TestSubscriberPending(t *testing.T) {
+	Convey("The update of another server is delivered once the followed one is silent", t, func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s := newSubscriber(ctx, nil, SubscriberOptions{FailoverTime: time.Second})
+		now := time.Now()
+		a := ServiceRecord{ID: "a", Address: "a"}
+		b := ServiceRecord{ID: "b", Address: "b"}
+
+		update, ok := s.accept(allTopic, Update{Origin: "one", Revision: 1, Records: []ServiceRecord{a}}, now)
+		So(ok, ShouldBeTrue)
+		s.members[allTopic] = update.Records
+
+		_, ok = s.accept(allTopic, Update{Origin: "two", Revision: 2, Records: []ServiceRecord{a, b}}, now)
+		So(ok, ShouldBeFalse)
+		_, ok = s.accept(allTopic, Update{Origin: "two", Revision: 1, Records: []ServiceRecord{a}}, now)
+		So(ok, ShouldBeFalse)
+		So(s.pending[allTopic].Revision, ShouldEqual, 2)
+
+		// not due yet
+		s.failover(now.Add(500 * time.Millisecond))
+		So(len(s.changes), ShouldEqual, 0)
+
+		s.failover(now.Add(2 * time.Second))
+		So(ids(<-s.changes), ShouldResemble, []string{"a", "b"})
+		So(<-s.events, ShouldResemble, Event{Type: Added, Record: b, Revision: 2})
+		So(s.following[allTopic].origin, ShouldEqual, "two")
+		So(s.pending, ShouldBeEmpty)
+	})
+}
+
+func TestSubscriberServerRestart(t *testing.T) {
+	Convey("The Subscriber follows a restarted server that does not publish again", t, func() {
+		urlServ := "tcp://127.0.0.1:40033"
+		urlPubSub := "tcp://127.0.0.1:50033"
+
+		server, err := Server(urlServ, urlPubSub, defaultOpts)
+		So(err, ShouldBeNil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		sub, err := NewSubscriberWithOptions(ctx, urlPubSub, SubscriberOptions{
+			Delivery:     LatestUpdate,
+			FailoverTime: 200 * time.Millisecond,
+		})
+		So(err, ShouldBeNil)
+
+		clientOne, err := Client(urlServ, "client1")
+		So(err, ShouldBeNil)
+		clients, ok := changesWithin(sub.Changes(), 2*time.Second)
+		So(ok, ShouldBeTrue)
+		So(ids(clients), ShouldResemble, []string{"client1"})
+
+		So(server.Close(), ShouldBeNil)
+		server, err = Server(urlServ, urlPubSub, defaultOpts)
+		So(err, ShouldBeNil)
+
+		// the new server publishes both clients once, with a new origin
+		clientTwo, err := Client(urlServ, "client2")
+		So(err, ShouldBeNil)
+		clients, ok = changesWithin(sub.Changes(), 2*time.Second)
+		So(ok, ShouldBeTrue)
+		So(ids(clients), ShouldResemble, []string{"client1", "client2"})
+
+		server.Cancel()
+		clientOne.Cancel()
+		clientTwo.Cancel()
+	})
+}
+
+func TestSubscriberSlowReader(t *testing.T) {
+	Convey("A slow reader gets the final membership", t, func() {
+		urlServ := "inproc://survey/15"
+		urlPubSub := "inproc://pubsub/15"
+
+		server, err := Server(urlServ, urlPubSub, defaultOpts)
+		So(err, ShouldBeNil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		sub, err := NewSubscriberWithOptions(ctx, urlPubSub, SubscriberOptions{Delivery: LatestUpdate})
+		So(err, ShouldBeNil)
+
+		var clients []*DiscoveryClient
+		for i := 0; i < 10; i++ {
+			client, err := Client(urlServ, fmt.Sprintf("client%d", i))
+			So(err, ShouldBeNil)
+			clients = append(clients, client)
+			time.Sleep(30 * time.Millisecond)
+		}
+
+		// the consumer was not reading, but the latest membership is there
+		time.Sleep(100 * time.Millisecond)
+		records := <-sub.Changes()
+		So(len(records), ShouldEqual, 10)
+
+		server.Cancel()
+		cancel()
+		for _, client := range clients {
+			client.Cancel()
+		}
+	})
+}
+
+func TestSubscriberLegacy(t *testing.T) {
+	Convey("A legacy Subscriber gets the membership of the old publishers", t, func() {
+		urlPubSub := "inproc://pubsub/32"
+
+		sock, err := pub.NewSocket()
+		So(err, ShouldBeNil)
+		defer sock.Close()
+		So(addTransports(sock, TransportOptions{}), ShouldBeNil)
+		So(sock.Listen(urlPubSub), ShouldBeNil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		sub, err := NewSubscriberWithOptions(ctx, urlPubSub, SubscriberOptions{Legacy: true})
+		So(err, ShouldBeNil)
+		time.Sleep(50 * time.Millisecond)
+
+		So(sock.Send([]byte("a|b")), ShouldBeNil)
+		clients := <-sub.Changes()
+		So(ids(clients), ShouldResemble, []string{"a", "b"})
+
+		// the publications of other topics are ignored
+		msg, err := encodePublication(serviceTopic("c"), Update{Origin: "o", Revision: 1,
+			Records: []ServiceRecord{{ID: "c", Address: "c", Service: "c"}}}, nil, nil)
+		So(err, ShouldBeNil)
+		So(sock.Send(msg), ShouldBeNil)
+
+		So(sock.Send([]byte("")), ShouldBeNil)
+		clients = <-sub.Changes()
+		So(clients, ShouldBeEmpty)
+
+		var types []EventType
+		for i := 0; i < 4; i++ {
+			event := <-sub.Events()
+			types = append(types, event.Type)
+		}
+		So(types, ShouldResemble, []EventType{Added, Added, Removed, Removed})
+	})
+}
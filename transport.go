@@ -0,0 +1,75 @@
+package gopherdiscovery
+
+import (
+	"crypto/tls"
+	"strings"
+
+	"github.com/gdamore/mangos"
+
+	"github.com/gdamore/mangos/transport/inproc"
+	"github.com/gdamore/mangos/transport/ipc"
+	"github.com/gdamore/mangos/transport/tcp"
+	"github.com/gdamore/mangos/transport/tlstcp"
+	"github.com/gdamore/mangos/transport/ws"
+	"github.com/gdamore/mangos/transport/wss"
+)
+
+// TransportOptions are the options of the transports of every socket
+type TransportOptions struct {
+	// TLSConfig for the tls+tcp:// and wss:// urls, for example
+	// tls+tcp://10.0.0.100:40007 or wss://10.0.0.100:40007/survey.
+	// The servers need their certificates and the clients the CA pool, with
+	// ClientAuth and client certificates the authentication is mutual. The
+	// wss:// urls only use TLS 1.2
+	TLSConfig *tls.Config
+
+	// Transports replace the supported transports, only these urls can be
+	// used then. Every supported transport if empty
+	Transports []mangos.Transport
+}
+
+// addTransports adds the supported transports to the socket. The websocket
+// transports let browsers and clients behind HTTP proxies reach the sockets,
+// for example ws://10.0.0.100:50007/pubsub, and inproc:// urls connect
+// sockets of the same process without any port
+func addTransports(sock mangos.Socket, opt TransportOptions) error {
+	transports := opt.Transports
+	if len(transports) == 0 {
+		transports = []mangos.Transport{
+			inproc.NewTransport(),
+			ipc.NewTransport(),
+			tcp.NewTransport(),
+			tlstcp.NewTransport(),
+			ws.NewTransport(),
+			wss.NewTransport(),
+		}
+	}
+	for _, transport := range transports {
+		sock.AddTransport(transport)
+	}
+
+	if opt.TLSConfig != nil {
+		return sock.SetOption(mangos.OptionTLSConfig, opt.TLSConfig)
+	}
+	return nil
+}
+
+// listen listens on the url with the endpointOptions
+func listen(sock mangos.Socket, url string, opt TransportOptions) error {
+	return sock.ListenOptions(url, endpointOptions(url, opt))
+}
+
+// dial dials the url with the endpointOptions
+func dial(sock mangos.Socket, url string, opt TransportOptions) error {
+	return sock.DialOptions(url, endpointOptions(url, opt))
+}
+
+// endpointOptions returns the options of the listener or dialer of the url.
+// The wss:// transport does not get the TLSConfig of the socket, only the
+// one of its listeners and dialers.
+func endpointOptions(url string, opt TransportOptions) map[string]interface{} {
+	if opt.TLSConfig == nil || !strings.HasPrefix(url, "wss://") {
+		return nil
+	}
+	return map[string]interface{}{mangos.OptionTLSConfig: opt.TLSConfig}
+}
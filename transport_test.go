@@ -0,0 +1,162 @@
+package gopherdiscovery
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// testTLS returns the configurations of a server and a client that
+// authenticate each other with certificates signed by the same CA
+func testTLS() (*tls.Config, *tls.Config, error) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gopherdiscovery CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	ca, err = x509.ParseCertificate(caDER)
+	if err != nil {
+		return nil, nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	certificate := func(serial int64, name string) (tls.Certificate, error) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+	}
+
+	serverCert, err := certificate(2, "server")
+	if err != nil {
+		return nil, nil, err
+	}
+	clientCert, err := certificate(3, "client")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	server := &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	client := &tls.Config{
+		Certificates: []tls.Certificate{clientCert},
+		RootCAs:      pool,
+		ServerName:   "127.0.0.1",
+	}
+	return server, client, nil
+}
+
+func TestTLSDiscovery(t *testing.T) {
+	Convey("Discover a client over TLS", t, func() {
+		urlServ := "tls+tcp://127.0.0.1:40025"
+		urlPubSub := "tls+tcp://127.0.0.1:50025"
+
+		serverTLS, clientTLS, err := testTLS()
+		So(err, ShouldBeNil)
+
+		opts := defaultOpts
+		opts.Transport = TransportOptions{TLSConfig: serverTLS}
+		server, err := Server(urlServ, urlPubSub, opts)
+		So(err, ShouldBeNil)
+
+		client, err := ClientWithOptions(urlServ, urlPubSub, ServiceRecord{ID: "client1", Address: "client1"},
+			ClientOptions{Transport: TransportOptions{TLSConfig: clientTLS}})
+		So(err, ShouldBeNil)
+
+		peers, err := client.Peers()
+		So(err, ShouldBeNil)
+		clients := <-peers
+		So(ids(clients), ShouldResemble, []string{"client1"})
+
+		server.Cancel()
+		client.Cancel()
+
+	})
+}
+
+func TestWebSocketDiscovery(t *testing.T) {
+	Convey("Discover a client over websockets", t, func() {
+		urlServ := "ws://127.0.0.1:40026/survey"
+		urlPubSub := "ws://127.0.0.1:50026/pubsub"
+
+		server, err := Server(urlServ, urlPubSub, defaultOpts)
+		So(err, ShouldBeNil)
+
+		client, err := ClientWithSub(urlServ, urlPubSub, "client1")
+		So(err, ShouldBeNil)
+
+		peers, err := client.Peers()
+		So(err, ShouldBeNil)
+		clients := <-peers
+		So(ids(clients), ShouldResemble, []string{"client1"})
+
+		server.Cancel()
+		client.Cancel()
+
+	})
+
+	Convey("Discover a client over secure websockets", t, func() {
+		urlServ := "wss://127.0.0.1:40027/survey"
+		urlPubSub := "wss://127.0.0.1:50027/pubsub"
+
+		serverTLS, clientTLS, err := testTLS()
+		So(err, ShouldBeNil)
+
+		opts := defaultOpts
+		opts.Transport = TransportOptions{TLSConfig: serverTLS}
+		server, err := Server(urlServ, urlPubSub, opts)
+		So(err, ShouldBeNil)
+
+		client, err := ClientWithOptions(urlServ, urlPubSub, ServiceRecord{ID: "client1", Address: "client1"},
+			ClientOptions{Transport: TransportOptions{TLSConfig: clientTLS}})
+		So(err, ShouldBeNil)
+
+		peers, err := client.Peers()
+		So(err, ShouldBeNil)
+		clients := <-peers
+		So(ids(clients), ShouldResemble, []string{"client1"})
+
+		server.Cancel()
+		client.Cancel()
+
+	})
+}